@@ -0,0 +1,157 @@
+package build
+
+import (
+	"fmt"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// actionKeyForInputs returns the action cache key of build when it is run on inputs.
+func actionKeyForInputs(build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry) (cache.Digest, error) {
+	actionInputs := make([]cache.ActionInput, 0, len(inputs))
+	for _, input := range inputs {
+		actionInputs = append(actionInputs, cache.NewActionInput(input))
+	}
+
+	key, err := cache.ActionKey(build.Info, actionInputs)
+	if err != nil {
+		return cache.Digest{}, fmt.Errorf("failed to compute action key for %s: %w", build.TargetFilePath, err)
+	}
+	return key, nil
+}
+
+// discoveredActionKey returns the key the outputs of build are recorded with when the
+// action reported the inputs it read. The dependency graph computes the same key from the
+// recorded inputs to decide whether the outputs are still up to date.
+func discoveredActionKey(build *buildgraph.BuildGraphNode, key cache.Digest, inputs []cache.FileCacheEntry, discovered []string, hasDiscovered bool) (cache.Digest, error) {
+	if !hasDiscovered {
+		return key, nil
+	}
+
+	actionInputs := make([]cache.ActionInput, 0, len(inputs))
+	for _, input := range inputs {
+		actionInputs = append(actionInputs, cache.NewActionInput(input))
+	}
+
+	key, err := cache.DiscoveredActionKey(build.Info, actionInputs, discovered)
+	if err != nil {
+		return cache.Digest{}, fmt.Errorf("failed to compute action key for %s: %w", build.TargetFilePath, err)
+	}
+	return key, nil
+}
+
+// restoreFromActionCache looks up the action of build in the action cache.
+// On a hit the recorded outputs are put back into the cache under their targets,
+// so the action does not have to be run again.
+func restoreFromActionCache(build *buildgraph.BuildGraphNode, key cache.Digest, inputs []cache.FileCacheEntry, c *cache.Cache) (bool, error) {
+	result, hit, err := c.GetAction(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up action for %s: %w", build.TargetFilePath, err)
+	}
+	if !hit || len(result.Outputs) == 0 {
+		return false, nil
+	}
+
+	outputKey, err := discoveredActionKey(build, key, inputs, result.DiscoveredInputs, result.HasDiscoveredInputs)
+	if err != nil {
+		return false, err
+	}
+
+	outputs := make([]cache.FileCacheEntry, 0, len(result.Outputs))
+	for _, output := range result.Outputs {
+		cacheEntry, hit, err := restoreOutput(output, c)
+		if err != nil {
+			return false, fmt.Errorf("failed to read output %s of %s: %w", output.Path, build.TargetFilePath, err)
+		}
+		if !hit {
+			return false, nil
+		}
+
+		cacheEntry.ActionKey = outputKey
+		outputs = append(outputs, cacheEntry)
+	}
+
+	outputs[0].DiscoveredInputs = result.DiscoveredInputs
+	outputs[0].HasDiscoveredInputs = result.HasDiscoveredInputs
+
+	for i, output := range outputs {
+		target := outputTarget(build, i, output.TargetPath)
+		if err := c.Set(target, output); err != nil {
+			return false, fmt.Errorf("failed to put output file %s into cache: %w", target, err)
+		}
+	}
+
+	fmt.Printf("Action cache hit for %s\n", build.TargetFilePath)
+	return true, nil
+}
+
+func restoreOutput(output cache.OutputFile, c *cache.Cache) (cache.FileCacheEntry, bool, error) {
+	if output.IsTree {
+		files, hit, err := c.GetTreeManifest(output.Digest)
+		if err != nil || !hit {
+			return cache.FileCacheEntry{}, hit, err
+		}
+		return cache.NewTree(output.Path, files), true, nil
+	}
+
+	// GetAction has checked that the blob is in the cache.
+	return cache.NewBlobTarget(output.Path, output.Digest), true, nil
+}
+
+// cacheActionResult stores the outputs of build as blobs, records them in the action cache
+// and puts them into the cache under their targets. discovered lists the inputs the action
+// reported to have read; it is nil for actions that do not report them.
+func cacheActionResult(build *buildgraph.BuildGraphNode, key cache.Digest, inputs []cache.FileCacheEntry, outputs []cache.FileCacheEntry, discovered []string, c *cache.Cache) error {
+	result := cache.ActionResult{
+		DiscoveredInputs:    discovered,
+		HasDiscoveredInputs: discovered != nil,
+	}
+	for _, output := range outputs {
+		var d cache.Digest
+		var err error
+		switch {
+		case output.IsTree:
+			// The files of a tree have already been stored by the executor.
+			d, err = c.PutTreeManifest(output.Tree)
+		case output.IsBlob:
+			d = output.HashFile
+		default:
+			d, err = c.PutBlob(output.File)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to store output %s of %s: %w", output.TargetPath, build.TargetFilePath, err)
+		}
+		result.Outputs = append(result.Outputs, cache.OutputFile{Path: output.TargetPath, Digest: d, IsTree: output.IsTree})
+	}
+
+	err := c.SetAction(key, result)
+	if err != nil {
+		return fmt.Errorf("failed to record action for %s: %w", build.TargetFilePath, err)
+	}
+
+	outputKey, err := discoveredActionKey(build, key, inputs, result.DiscoveredInputs, result.HasDiscoveredInputs)
+	if err != nil {
+		return err
+	}
+
+	// The result is also recorded under the key of the inputs that were actually read,
+	// which is the key the next build computes once the discovered inputs are known.
+	if outputKey != key {
+		if err := c.SetAction(outputKey, result); err != nil {
+			return fmt.Errorf("failed to record action for %s: %w", build.TargetFilePath, err)
+		}
+	}
+
+	outputs[0].DiscoveredInputs = result.DiscoveredInputs
+	outputs[0].HasDiscoveredInputs = result.HasDiscoveredInputs
+
+	for i, output := range outputs {
+		output.ActionKey = outputKey
+		target := outputTarget(build, i, output.TargetPath)
+		if err := c.Set(target, output); err != nil {
+			return fmt.Errorf("failed to put output file %s into cache: %w", target, err)
+		}
+	}
+	return nil
+}
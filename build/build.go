@@ -1,41 +1,72 @@
 package build
 
 import (
-	"archive/tar"
-	"bytes"
 	"context"
 	"fmt"
-	"io"
 	"os"
-	"strings"
 
 	"github.com/julebarn/BSc-build-systems/buildgraph"
 	"github.com/julebarn/BSc-build-systems/cache"
-	"github.com/moby/moby/api/types/container"
-	"github.com/moby/moby/api/types/image"
-	"github.com/moby/moby/client"
 )
 
+// Executor runs the build command of a node on its inputs and returns the produced
+// outputs, in the order of build.Info.DeclaredOutputs. The cache holds the content of
+// directory inputs, and the files of directory outputs are stored in it.
+type Executor interface {
+	Execute(ctx context.Context, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, error)
+}
+
+// Names of the executors a node can select with the executor field of build.json.
+const (
+	DockerExecutorName = "docker"
+	LocalExecutorName  = "local"
+	RemoteExecutorName = "remote"
+)
+
+// DefaultExecutorName is used for nodes that do not select an executor.
+const DefaultExecutorName = DockerExecutorName
+
 type BuildEnvironment struct {
-	dockerClient *client.Client
+	executors map[string]Executor
+
+	// dockerErr is returned for nodes that use docker when the docker client could not be created,
+	// so builds that only use other executors still work without a Docker setup.
+	dockerErr error
+
+	// keepGoing makes BuildAll continue with the nodes that do not depend on a failed one.
+	keepGoing bool
 
 	ctx context.Context
 }
 
 func NewBuildEnvironment(ctx context.Context) (*BuildEnvironment, error) {
-	// TODO/NB:  useing client.FromEnv to get Docker client configuration from environment variables.
-	// is probably not the best way to garantie that the file build is correctly configured.
+	env := &BuildEnvironment{
+		executors: map[string]Executor{
+			LocalExecutorName: NewLocalExecutor(),
+		},
 
-	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+		ctx: ctx,
+	}
+
+	dockerExecutor, err := NewDockerExecutor()
 	if err != nil {
-		return nil, err
+		env.dockerErr = fmt.Errorf("failed to create Docker client: %w", err)
+	} else {
+		env.executors[DockerExecutorName] = dockerExecutor
 	}
 
-	return &BuildEnvironment{
-		dockerClient: dockerClient,
+	return env, nil
+}
 
-		ctx: ctx,
-	}, nil
+// SetExecutor registers executor under name, replacing any executor with that name.
+func (env *BuildEnvironment) SetExecutor(name string, executor Executor) {
+	env.executors[name] = executor
+}
+
+// SetKeepGoing selects whether BuildAll stops at the first failed node or builds
+// every node that does not depend on a failed one.
+func (env *BuildEnvironment) SetKeepGoing(keepGoing bool) {
+	env.keepGoing = keepGoing
 }
 
 func (env *BuildEnvironment) Build(build *buildgraph.BuildGraphNode, c *cache.Cache) error {
@@ -43,208 +74,134 @@ func (env *BuildEnvironment) Build(build *buildgraph.BuildGraphNode, c *cache.Ca
 	if build.IsSourceFile {
 		return readAndCacheSourceFile(build, c)
 	}
+	if build.ProducedBy != "" {
+		return checkProducedOutput(build, c)
+	}
 	return executeBuildProcess(env, build, c)
 }
 
-func executeBuildProcess(env *BuildEnvironment, build *buildgraph.BuildGraphNode, c *cache.Cache) error {
-
-	err := env.pullImageifNeeded(env.ctx, build.Info.DockerImage)
-	if err != nil {
-		return fmt.Errorf("failed to pull Docker image %s: %w", build.Info.DockerImage, err)
+func (env *BuildEnvironment) executorFor(build *buildgraph.BuildGraphNode) (Executor, error) {
+	name := build.Info.Executor
+	if name == "" {
+		name = DefaultExecutorName
 	}
 
-	resp, clean, err := createBuildContainer(build, env, &container.Config{
-		Image: build.Info.DockerImage,
-		Cmd:   strings.Fields(build.Info.BuildCommand),
-	})
-	if err != nil {
-		return fmt.Errorf("failed to create container for build %s: %w", build.TargetFilePath, err)
+	executor, exists := env.executors[name]
+	if !exists {
+		if name == DockerExecutorName && env.dockerErr != nil {
+			return nil, env.dockerErr
+		}
+		if name == RemoteExecutorName {
+			return nil, fmt.Errorf("%s uses the remote executor, but no remote executor is configured", build.TargetFilePath)
+		}
+		return nil, fmt.Errorf("unknown executor %q for %s", name, build.TargetFilePath)
 	}
-	defer clean()
+	return executor, nil
+}
+
+func executeBuildProcess(env *BuildEnvironment, build *buildgraph.BuildGraphNode, c *cache.Cache) error {
 
-	// Copy dependency files into the container
-	err = copyDependenciesToContainer(build, c, env, resp)
+	executor, err := env.executorFor(build)
 	if err != nil {
 		return err
 	}
 
-	err = env.dockerClient.ContainerStart(env.ctx, resp.ID, container.StartOptions{})
+	inputs, err := getDependencyEntries(build, c)
 	if err != nil {
-		return fmt.Errorf("failed to start container for build %s: %w", build.TargetFilePath, err)
+		return err
 	}
 
-	// TODO/NB: this is should not be a blocking call, but in stead run multiple builds in parallel.
-	err = waitForContainer(env, resp)
+	actionKey, err := actionKeyForInputs(build, inputs)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Build completed for %s\n", build.TargetFilePath)
-	//copy the output file from the container to the cache
-	outputFile := build.Info.OutputFilePath
-	if outputFile == "" {
-		outputFile = build.TargetFilePath // Default to target file path if no output specified
-	}
-
-	outputReader, _, err := env.dockerClient.CopyFromContainer(env.ctx, resp.ID, outputFile)
-
+	restored, err := restoreFromActionCache(build, actionKey, inputs, c)
 	if err != nil {
-		return fmt.Errorf("failed to copy output file %s from container: %w", outputFile, err)
+		return err
+	}
+	if restored {
+		return nil
 	}
-	defer outputReader.Close()
-
-	tr := tar.NewReader(outputReader)
-	var fileData bytes.Buffer
 
-	for {
-		header, err := tr.Next()
-		if err == io.EOF {
-			break
-		}
+	if build.Info.DiscoversHeaders() {
+		outputs, headers, err := executeWithDepfile(env.ctx, executor, build, inputs, c)
 		if err != nil {
-			return fmt.Errorf("error reading tar header: %w", err)
-		}
-
-		if header.Typeflag == tar.TypeReg {
-			if _, err := io.Copy(&fileData, tr); err != nil {
-				return fmt.Errorf("error extracting tar file: %w", err)
-			}
-			break
+			return err
 		}
+		return cacheActionResult(build, actionKey, inputs, outputs, headers, c)
 	}
 
-	cacheEntry := cache.NewTarget(outputFile, fileData.Bytes())
-
-	err = c.Set(build.TargetFilePath, cacheEntry)
+	outputs, err := executor.Execute(env.ctx, build, inputs, c)
 	if err != nil {
-		return fmt.Errorf("failed to put output file %s into cache: %w", build.TargetFilePath, err)
+		return err
 	}
 
-	return nil
+	return cacheActionResult(build, actionKey, inputs, outputs, nil, c)
 }
 
-func createBuildContainer(build *buildgraph.BuildGraphNode, env *BuildEnvironment, containerConfig *container.Config) (container.CreateResponse, func(), error) {
-	fmt.Printf("Building %s with command: %s\n", build.TargetFilePath, build.Info.BuildCommand)
-
-	resp, err := env.dockerClient.ContainerCreate(env.ctx, containerConfig, nil, nil, nil, "")
-	if err != nil {
-		return container.CreateResponse{}, nil, fmt.Errorf("failed to create container for build %s: %w", build.TargetFilePath, err)
+// outputTarget returns the target the i-th output of build is cached under.
+// The first output belongs to build itself, the others are targets of their own.
+func outputTarget(build *buildgraph.BuildGraphNode, i int, outputPath string) string {
+	if i == 0 {
+		return build.TargetFilePath
 	}
-
-	clean := func() {
-		if err := env.dockerClient.ContainerRemove(env.ctx, resp.ID, container.RemoveOptions{
-			Force: true,
-		}); err != nil {
-			fmt.Printf("Failed to remove container %s: %v\n", resp.ID, err)
-		}
-	}
-	return resp, clean, nil
+	return outputPath
 }
 
-func waitForContainer(env *BuildEnvironment, resp container.CreateResponse) error {
-	statusCh, errCh := env.dockerClient.ContainerWait(env.ctx, resp.ID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		return fmt.Errorf("container wait failed: %w", err)
-	case <-statusCh:
-		return nil
+// checkProducedOutput verifies that an additional output has been put into the cache
+// by the node producing it, which is always a dependency of the output's node.
+func checkProducedOutput(build *buildgraph.BuildGraphNode, c *cache.Cache) error {
+	_, hit, err := c.Get(build.TargetFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to get cache entry for %s: %w", build.TargetFilePath, err)
+	}
+	if !hit {
+		return fmt.Errorf("output %s was not produced by %s", build.TargetFilePath, build.ProducedBy)
 	}
+	return nil
 }
 
-func copyDependenciesToContainer(build *buildgraph.BuildGraphNode, c *cache.Cache, env *BuildEnvironment, resp container.CreateResponse) error {
+// getDependencyEntries returns the cache entries of all dependencies of build.
+// The dependencies must have been built before.
+func getDependencyEntries(build *buildgraph.BuildGraphNode, c *cache.Cache) ([]cache.FileCacheEntry, error) {
+	var entries []cache.FileCacheEntry
 	for _, dep := range build.Dependencies {
 		FileCacheEntry, hit, err := c.Get(dep.TargetFilePath)
 		if err != nil {
-			return fmt.Errorf("failed to get cache entry for %s: %w", dep.TargetFilePath, err)
+			return nil, fmt.Errorf("failed to get cache entry for %s: %w", dep.TargetFilePath, err)
 		}
 		if !hit {
-			fmt.Println("Cache miss for dependency:", dep.TargetFilePath)
-		}
-
-		fmt.Println("Copying dependency to container:", dep.TargetFilePath)
-
-		err = env.dockerClient.CopyToContainer(
-			env.ctx,
-			resp.ID,
-			"/",
-			getTarFromCacheEntry(FileCacheEntry),
-			container.CopyToContainerOptions{
-				AllowOverwriteDirWithFile: true,
-			})
-		if err != nil {
-			return fmt.Errorf("failed to copy dependency %s to container: %w", dep.TargetFilePath, err)
+			return nil, fmt.Errorf("dependency %s of %s is not in the cache", dep.TargetFilePath, build.TargetFilePath)
 		}
+		entries = append(entries, FileCacheEntry)
 	}
-	return nil
+	return entries, nil
 }
 
 func readAndCacheSourceFile(build *buildgraph.BuildGraphNode, c *cache.Cache) error {
-	data, err := os.ReadFile(build.TargetFilePath)
+	info, err := os.Stat(build.TargetFilePath)
 	if err != nil {
 		return fmt.Errorf("failed to read source file %s: %w", build.TargetFilePath, err)
 	}
 
-	cacheEntry := cache.NewTarget(build.TargetFilePath, data)
-	err = c.Set(build.TargetFilePath, cacheEntry)
-	if err != nil {
-		return fmt.Errorf("failed to cache source file %s: %w", build.TargetFilePath, err)
-	}
-
-	return nil
-}
-
-func getTarFromCacheEntry(FileCacheEntry cache.FileCacheEntry) io.Reader {
-	var buf bytes.Buffer
-	tw := tar.NewWriter(&buf)
-
-	header := &tar.Header{
-		Name:     FileCacheEntry.TargetPath,
-		Size:     int64(len(FileCacheEntry.File)),
-		Typeflag: tar.TypeReg,
-	}
-
-	if err := tw.WriteHeader(header); err != nil {
-		fmt.Printf("Error writing tar header: %v\n", err)
-		return nil
-	}
-
-	if _, err := tw.Write(FileCacheEntry.File); err != nil {
-		fmt.Printf("Error writing data to tar: %v\n", err)
-		return nil
-	}
-
-	if err := tw.Close(); err != nil {
-		fmt.Printf("Error closing tar writer: %v\n", err)
-		return nil
+	if info.IsDir() {
+		cacheEntry, err := c.PutDirectory(build.TargetFilePath, build.TargetFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to cache source directory %s: %w", build.TargetFilePath, err)
+		}
+		return c.Set(build.TargetFilePath, cacheEntry)
 	}
 
-	return &buf
-
-}
-
-func (env *BuildEnvironment) pullImageifNeeded(ctx context.Context, imageName string) error {
-	imgLst, err := env.dockerClient.ImageList(ctx, image.ListOptions{
-		All: true,
-	})
+	cacheEntry, err := c.PutFile(build.TargetFilePath, build.TargetFilePath)
 	if err != nil {
-		return err
-	}
-
-	for _, img := range imgLst {
-		if img.RepoTags != nil && len(img.RepoTags) > 0 && img.RepoTags[0] == imageName {
-			fmt.Printf("Image %s already exists, skipping pull.\n", imageName)
-			return nil
-		}
+		return fmt.Errorf("failed to read source file %s: %w", build.TargetFilePath, err)
 	}
 
-	// If we reach here, the image is not found locally, so we need to pull it.
-	fmt.Printf("Pulling Docker image: %s\n", imageName)
-	reader, err := env.dockerClient.ImagePull(ctx, imageName, image.PullOptions{})
+	err = c.Set(build.TargetFilePath, cacheEntry)
 	if err != nil {
-		return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+		return fmt.Errorf("failed to cache source file %s: %w", build.TargetFilePath, err)
 	}
-	defer reader.Close()
-	io.Copy(os.Stdout, reader) // Show image pull progress
 
 	return nil
 }
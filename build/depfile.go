@@ -0,0 +1,168 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// executeWithDepfile runs a C or C++ compile so that the compiler writes a depfile,
+// and returns the outputs of build together with the headers listed in the depfile.
+// The depfile itself is only returned as an output if build declares it.
+func executeWithDepfile(ctx context.Context, executor Executor, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, []string, error) {
+	node, depfile, declared, err := depfileNode(build)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	outputs, err := executor.Execute(ctx, node, inputs, c)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	workspaceDir := ""
+	if _, ok := executor.(*DockerExecutor); ok {
+		workspaceDir = containerWorkspace
+	}
+
+	if !declared {
+		data, err := c.ReadFile(outputs[len(outputs)-1])
+		if err != nil {
+			return nil, nil, err
+		}
+		return outputs[:len(outputs)-1], parseDepfile(data, build.Info.WorkingDir, workspaceDir), nil
+	}
+
+	for _, output := range outputs {
+		if output.TargetPath == depfile {
+			data, err := c.ReadFile(output)
+			if err != nil {
+				return nil, nil, err
+			}
+			return outputs, parseDepfile(data, build.Info.WorkingDir, workspaceDir), nil
+		}
+	}
+	return nil, nil, fmt.Errorf("depfile %s of %s is missing from its outputs", depfile, build.TargetFilePath)
+}
+
+// depfileNode returns a copy of build whose command writes a depfile and whose outputs
+// include it. Commands that already pass -MF keep their depfile; declared reports whether
+// that depfile is one of the declared outputs of build.
+func depfileNode(build *buildgraph.BuildGraphNode) (node *buildgraph.BuildGraphNode, depfile string, declared bool, err error) {
+	outputs := build.Info.DeclaredOutputs(build.TargetFilePath)
+
+	command := build.Info.BuildCommand
+	args := strings.Fields(command)
+	for i, arg := range args {
+		if arg == "-MF" {
+			if i+1 == len(args) {
+				return nil, "", false, fmt.Errorf("-MF in the command of %s is not followed by a file name", build.TargetFilePath)
+			}
+			depfile = build.Info.WorkspacePath(args[i+1])
+		} else if strings.HasPrefix(arg, "-MF") {
+			depfile = build.Info.WorkspacePath(strings.TrimPrefix(arg, "-MF"))
+		}
+	}
+	if depfile == "" {
+		depfile = outputs[0].Path + ".d"
+		command += " -MD -MF " + build.Info.CommandPath(depfile)
+	}
+
+	copied := *build
+	copied.Info.BuildCommand = command
+	copied.Info.Outputs = nil
+	for _, output := range outputs {
+		if buildinfo.RelativePath(output.Path) == buildinfo.RelativePath(depfile) {
+			declared = true
+			depfile = output.Path
+		}
+		if output.IsDirectory {
+			copied.Info.Outputs = append(copied.Info.Outputs, output.Path+"/")
+		} else {
+			copied.Info.Outputs = append(copied.Info.Outputs, output.Path)
+		}
+	}
+	if !declared {
+		copied.Info.Outputs = append(copied.Info.Outputs, depfile)
+	}
+
+	return &copied, depfile, declared, nil
+}
+
+// parseDepfile returns the prerequisites of the make rules in a depfile as paths relative
+// to the workspace root. The depfile names them relative to workingDir, the directory the
+// compiler ran in, or as absolute paths below workspaceDir, where the executor placed the
+// workspace, e.g. for headers found through -I/workspace/include. Other absolute paths,
+// i.e. system headers, are left out. workspaceDir is empty if it is not known.
+func parseDepfile(data []byte, workingDir string, workspaceDir string) []string {
+	text := strings.ReplaceAll(string(data), "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\\\n", " ")
+
+	seen := make(map[string]bool)
+	deps := []string{}
+
+	for _, line := range strings.Split(text, "\n") {
+		// The targets of a rule end at the first colon followed by a blank.
+		colon := strings.Index(line+" ", ": ")
+		if colon < 0 {
+			continue
+		}
+
+		for _, dep := range splitDepfileWords(line[colon+1:]) {
+			if path.IsAbs(dep) {
+				rel, inWorkspace := strings.CutPrefix(path.Clean(dep), workspaceDir+"/")
+				if workspaceDir == "" || !inWorkspace {
+					continue
+				}
+				dep = rel
+			} else {
+				dep = path.Join(workingDir, dep)
+			}
+			dep = buildinfo.RelativePath(dep)
+			if !seen[dep] {
+				seen[dep] = true
+				deps = append(deps, dep)
+			}
+		}
+	}
+
+	sort.Strings(deps)
+	return deps
+}
+
+// splitDepfileWords splits the prerequisites of a rule at unescaped blanks.
+func splitDepfileWords(s string) []string {
+	var words []string
+	var word strings.Builder
+
+	flush := func() {
+		if word.Len() > 0 {
+			words = append(words, word.String())
+			word.Reset()
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\' && i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '#'):
+			word.WriteByte(s[i+1])
+			i++
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '$':
+			word.WriteByte('$')
+			i++
+		case s[i] == ' ' || s[i] == '\t':
+			flush()
+		default:
+			word.WriteByte(s[i])
+		}
+	}
+	flush()
+
+	return words
+}
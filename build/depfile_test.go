@@ -0,0 +1,68 @@
+package build
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+func TestParseDepfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		depfile      string
+		workingDir   string
+		workspaceDir string
+		want         []string
+	}{
+		{
+			name:       "relative to the working directory",
+			depfile:    "add.o: add.c add.h \\\n ../include/numbers.h\n",
+			workingDir: "lib",
+			want:       []string{"include/numbers.h", "lib/add.c", "lib/add.h"},
+		},
+		{
+			name:         "absolute in the workspace",
+			depfile:      "add.o: add.c /workspace/include/numbers.h /usr/include/stdio.h\n",
+			workingDir:   "lib",
+			workspaceDir: "/workspace",
+			want:         []string{"include/numbers.h", "lib/add.c"},
+		},
+		{
+			name:    "absolute without a known workspace",
+			depfile: "add.o: add.c /workspace/include/numbers.h\n",
+			want:    []string{"add.c"},
+		},
+		{
+			name:         "outside the workspace",
+			depfile:      "add.o: add.c /workspace2/numbers.h /workspace/../usr/include/stdio.h\n",
+			workspaceDir: "/workspace",
+			want:         []string{"add.c"},
+		},
+		{
+			name:    "escaped blanks",
+			depfile: "my\\ file.o: my\\ file.c\n",
+			want:    []string{"my file.c"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := parseDepfile([]byte(tt.depfile), tt.workingDir, tt.workspaceDir)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDepfile = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDepfileNodeMissingFileName(t *testing.T) {
+	node := &buildgraph.BuildGraphNode{
+		TargetFilePath: "add.o",
+		Info:           buildinfo.Info{BuildCommand: "gcc -c add.c -o add.o -MD -MF"},
+	}
+	if _, _, _, err := depfileNode(node); err == nil {
+		t.Error("depfileNode accepted -MF without a file name")
+	}
+}
@@ -0,0 +1,428 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/cache"
+	"github.com/moby/moby/api/pkg/stdcopy"
+	"github.com/moby/moby/api/types/container"
+	"github.com/moby/moby/api/types/image"
+	"github.com/moby/moby/client"
+)
+
+// containerWorkspace is the directory of the container the inputs are copied to and the
+// outputs are read from, so they cannot overwrite the files of the image.
+const containerWorkspace = "/workspace"
+
+// DockerExecutor runs every build node in a fresh container of the node's docker image.
+type DockerExecutor struct {
+	dockerClient *client.Client
+}
+
+func NewDockerExecutor() (*DockerExecutor, error) {
+	// TODO/NB:  useing client.FromEnv to get Docker client configuration from environment variables.
+	// is probably not the best way to garantie that the file build is correctly configured.
+
+	dockerClient, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, err
+	}
+
+	return &DockerExecutor{
+		dockerClient: dockerClient,
+	}, nil
+}
+
+func (e *DockerExecutor) Execute(ctx context.Context, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, error) {
+
+	err := e.pullImageifNeeded(ctx, build.Info.DockerImage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull Docker image %s: %w", build.Info.DockerImage, err)
+	}
+
+	resp, clean, err := e.createBuildContainer(ctx, build, &container.Config{
+		Image:      build.Info.DockerImage,
+		Cmd:        strings.Fields(build.Info.BuildCommand),
+		WorkingDir: containerWorkingDir(build),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create container for build %s: %w", build.TargetFilePath, err)
+	}
+	defer clean()
+
+	// Copy dependency files into the container
+	err = e.copyDependenciesToContainer(ctx, inputs, c, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.dockerClient.ContainerStart(ctx, resp.ID, container.StartOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to start container for build %s: %w", build.TargetFilePath, err)
+	}
+
+	// Blocking is fine here: BuildAll runs independent nodes in their own goroutines.
+	exitCode, err := e.waitForContainer(ctx, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	log, err := e.readContainerLogs(ctx, resp)
+	if err != nil {
+		return nil, err
+	}
+
+	if exitCode != 0 {
+		return nil, &BuildError{
+			Target:   build.TargetFilePath,
+			Command:  build.Info.BuildCommand,
+			ExitCode: exitCode,
+			Log:      log,
+		}
+	}
+
+	if log != "" {
+		fmt.Printf("Output of %s:\n%s", build.TargetFilePath, log)
+	}
+
+	fmt.Printf("Build completed for %s\n", build.TargetFilePath)
+
+	//copy the output files from the container to the cache
+	var outputs []cache.FileCacheEntry
+	for _, output := range build.Info.DeclaredOutputs(build.TargetFilePath) {
+		var cacheEntry cache.FileCacheEntry
+		if output.IsDirectory {
+			cacheEntry, err = e.copyOutputDirectoryFromContainer(ctx, resp, output.Path, c)
+		} else {
+			cacheEntry, err = e.copyOutputFromContainer(ctx, resp, output.Path, c)
+		}
+		if err != nil {
+			return nil, err
+		}
+		outputs = append(outputs, cacheEntry)
+	}
+
+	return outputs, nil
+}
+
+// copyOutputFromContainer streams an output file from the container into the cache.
+func (e *DockerExecutor) copyOutputFromContainer(ctx context.Context, resp container.CreateResponse, outputFile string, c *cache.Cache) (cache.FileCacheEntry, error) {
+	outputReader, _, err := e.dockerClient.CopyFromContainer(ctx, resp.ID, path.Join(containerWorkspace, outputFile))
+
+	if err != nil {
+		return cache.FileCacheEntry{}, fmt.Errorf("failed to copy output file %s from container: %w", outputFile, err)
+	}
+	defer outputReader.Close()
+
+	tr := tar.NewReader(outputReader)
+
+	found := "nothing"
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cache.FileCacheEntry{}, fmt.Errorf("error reading tar header: %w", err)
+		}
+
+		if header.Typeflag == tar.TypeReg {
+			entry, err := c.PutReader(outputFile, tr, header.Size)
+			if err != nil {
+				return cache.FileCacheEntry{}, fmt.Errorf("error extracting tar file: %w", err)
+			}
+			return entry, nil
+		}
+		if found == "nothing" {
+			found = fmt.Sprintf("%s %s", tarTypeName(header.Typeflag), header.Name)
+		}
+	}
+
+	return cache.FileCacheEntry{}, fmt.Errorf("output file %s is not a regular file: the container holds %s", outputFile, found)
+}
+
+// tarTypeName describes the type of a tar entry in errors.
+func tarTypeName(typeflag byte) string {
+	switch typeflag {
+	case tar.TypeDir:
+		return "the directory"
+	case tar.TypeSymlink:
+		return "the symbolic link"
+	case tar.TypeLink:
+		return "the hard link"
+	case tar.TypeFifo:
+		return "the named pipe"
+	case tar.TypeChar, tar.TypeBlock:
+		return "the device"
+	default:
+		return fmt.Sprintf("the entry of type %q", typeflag)
+	}
+}
+
+// copyOutputDirectoryFromContainer copies a directory output from the container and
+// stores every file in it as a blob.
+func (e *DockerExecutor) copyOutputDirectoryFromContainer(ctx context.Context, resp container.CreateResponse, outputDir string, c *cache.Cache) (cache.FileCacheEntry, error) {
+	outputReader, _, err := e.dockerClient.CopyFromContainer(ctx, resp.ID, path.Join(containerWorkspace, outputDir))
+	if err != nil {
+		return cache.FileCacheEntry{}, fmt.Errorf("failed to copy output directory %s from container: %w", outputDir, err)
+	}
+	defer outputReader.Close()
+
+	var files []cache.TreeFile
+	tr := tar.NewReader(outputReader)
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return cache.FileCacheEntry{}, fmt.Errorf("error reading tar header: %w", err)
+		}
+
+		// The archive contains the directory itself, so every name starts with its base name.
+		_, name, found := strings.Cut(strings.TrimSuffix(header.Name, "/"), "/")
+		if !found || name == "" {
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			files = append(files, cache.TreeFile{Path: name, Mode: fs.ModeDir | 0755})
+		case tar.TypeSymlink:
+			files = append(files, cache.TreeFile{Path: name, Mode: fs.ModeSymlink | 0777, Link: header.Linkname})
+		case tar.TypeReg:
+			d, _, err := c.PutBlobFrom(tr, header.Size)
+			if err != nil {
+				return cache.FileCacheEntry{}, fmt.Errorf("failed to store %s of output directory %s: %w", name, outputDir, err)
+			}
+
+			files = append(files, cache.TreeFile{
+				Path:   name,
+				Mode:   header.FileInfo().Mode().Perm(),
+				Digest: d,
+			})
+		default:
+			return cache.FileCacheEntry{}, fmt.Errorf("%s of output directory %s is not a regular file, symbolic link or directory", name, outputDir)
+		}
+	}
+
+	return cache.NewTree(outputDir, files), nil
+}
+
+func (e *DockerExecutor) createBuildContainer(ctx context.Context, build *buildgraph.BuildGraphNode, containerConfig *container.Config) (container.CreateResponse, func(), error) {
+	fmt.Printf("Building %s with command: %s\n", build.TargetFilePath, build.Info.BuildCommand)
+
+	resp, err := e.dockerClient.ContainerCreate(ctx, containerConfig, nil, nil, nil, "")
+	if err != nil {
+		return container.CreateResponse{}, nil, fmt.Errorf("failed to create container for build %s: %w", build.TargetFilePath, err)
+	}
+
+	clean := func() {
+		if err := e.dockerClient.ContainerRemove(ctx, resp.ID, container.RemoveOptions{
+			Force: true,
+		}); err != nil {
+			fmt.Printf("Failed to remove container %s: %v\n", resp.ID, err)
+		}
+	}
+	return resp, clean, nil
+}
+
+// containerWorkingDir returns the directory the build command of build runs in. A node
+// without a working directory runs in the workspace.
+func containerWorkingDir(build *buildgraph.BuildGraphNode) string {
+	return path.Join(containerWorkspace, build.Info.WorkingDir)
+}
+
+// waitForContainer blocks until the container has stopped and returns its exit code.
+func (e *DockerExecutor) waitForContainer(ctx context.Context, resp container.CreateResponse) (int64, error) {
+	statusCh, errCh := e.dockerClient.ContainerWait(ctx, resp.ID, container.WaitConditionNotRunning)
+	select {
+	case err := <-errCh:
+		return 0, fmt.Errorf("container wait failed: %w", err)
+	case status := <-statusCh:
+		if status.Error != nil {
+			return 0, fmt.Errorf("container wait failed: %s", status.Error.Message)
+		}
+		return status.StatusCode, nil
+	}
+}
+
+// readContainerLogs returns the combined stdout and stderr of a stopped container.
+func (e *DockerExecutor) readContainerLogs(ctx context.Context, resp container.CreateResponse) (string, error) {
+	logReader, err := e.dockerClient.ContainerLogs(ctx, resp.ID, container.LogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read logs of container %s: %w", resp.ID, err)
+	}
+	defer logReader.Close()
+
+	var log bytes.Buffer
+	if _, err := stdcopy.StdCopy(&log, &log, logReader); err != nil {
+		return "", fmt.Errorf("failed to demultiplex logs of container %s: %w", resp.ID, err)
+	}
+	return log.String(), nil
+}
+
+func (e *DockerExecutor) copyDependenciesToContainer(ctx context.Context, inputs []cache.FileCacheEntry, c *cache.Cache, resp container.CreateResponse) error {
+	for _, FileCacheEntry := range inputs {
+		fmt.Println("Copying dependency to container:", FileCacheEntry.TargetPath)
+
+		// The archive is extracted at the root, so its names are relative to it.
+		tarReader := getTarFromCacheEntry(strings.TrimPrefix(containerWorkspace, "/"), FileCacheEntry, c)
+		err := e.dockerClient.CopyToContainer(
+			ctx,
+			resp.ID,
+			"/",
+			tarReader,
+			container.CopyToContainerOptions{
+				AllowOverwriteDirWithFile: true,
+			})
+		tarReader.Close()
+		if err != nil {
+			return fmt.Errorf("failed to copy dependency %s to container: %w", FileCacheEntry.TargetPath, err)
+		}
+	}
+	return nil
+}
+
+// getTarFromCacheEntry returns a tar archive that places the file or directory of the
+// entry at its target path below dir when it is extracted at the root of the container. The
+// archive is written while it is read, so files are streamed from the cache instead of
+// being held in memory. Closing the reader stops writing the archive.
+func getTarFromCacheEntry(dir string, FileCacheEntry cache.FileCacheEntry, c *cache.Cache) io.ReadCloser {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeTarFromCacheEntry(pw, dir, FileCacheEntry, c))
+	}()
+	return pr
+}
+
+func writeTarFromCacheEntry(w io.Writer, dir string, FileCacheEntry cache.FileCacheEntry, c *cache.Cache) error {
+	tw := tar.NewWriter(w)
+	target := path.Join(dir, FileCacheEntry.TargetPath)
+
+	if !FileCacheEntry.IsTree {
+		r, size, err := c.Open(FileCacheEntry)
+		if err != nil {
+			return err
+		}
+		err = writeTarFile(tw, target, 0644, r, size)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, file := range FileCacheEntry.Tree {
+		name := path.Join(target, file.Path)
+
+		if !file.IsRegular() {
+			if err := writeTarLink(tw, name, file); err != nil {
+				return err
+			}
+			continue
+		}
+
+		size, hit, err := c.BlobSize(file.Digest)
+		if err != nil {
+			return err
+		}
+		if !hit {
+			return fmt.Errorf("content of %s is missing from the cache", name)
+		}
+		r, hit, err := c.OpenBlob(file.Digest)
+		if err != nil {
+			return err
+		}
+		if !hit {
+			return fmt.Errorf("content of %s is missing from the cache", name)
+		}
+
+		err = writeTarFile(tw, name, int64(file.Mode), r, size)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return fmt.Errorf("error closing tar writer: %w", err)
+	}
+	return nil
+}
+
+// writeTarFile adds a file with the size bytes read from r to the archive.
+func writeTarFile(tw *tar.Writer, name string, mode int64, r io.Reader, size int64) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     mode,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("error writing tar header: %w", err)
+	}
+
+	if _, err := io.Copy(tw, r); err != nil {
+		return fmt.Errorf("error writing data to tar: %w", err)
+	}
+	return nil
+}
+
+// writeTarLink adds the symbolic link or empty directory of a tree to the archive.
+func writeTarLink(tw *tar.Writer, name string, file cache.TreeFile) error {
+	header := &tar.Header{
+		Name:     name,
+		Mode:     int64(file.Mode.Perm()),
+		Typeflag: tar.TypeDir,
+	}
+	if file.IsSymlink() {
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = file.Link
+	}
+
+	if err := tw.WriteHeader(header); err != nil {
+		return fmt.Errorf("error writing tar header: %w", err)
+	}
+	return nil
+}
+
+func (e *DockerExecutor) pullImageifNeeded(ctx context.Context, imageName string) error {
+	imgLst, err := e.dockerClient.ImageList(ctx, image.ListOptions{
+		All: true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, img := range imgLst {
+		if img.RepoTags != nil && len(img.RepoTags) > 0 && img.RepoTags[0] == imageName {
+			fmt.Printf("Image %s already exists, skipping pull.\n", imageName)
+			return nil
+		}
+	}
+
+	// If we reach here, the image is not found locally, so we need to pull it.
+	fmt.Printf("Pulling Docker image: %s\n", imageName)
+	reader, err := e.dockerClient.ImagePull(ctx, imageName, image.PullOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to pull image %s: %w", imageName, err)
+	}
+	defer reader.Close()
+	io.Copy(os.Stdout, reader) // Show image pull progress
+
+	return nil
+}
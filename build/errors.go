@@ -0,0 +1,106 @@
+package build
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// logTailLines is the number of log lines kept in the message of a BuildError.
+const logTailLines = 20
+
+// summaryLogLines is the number of log lines of every failure in a KeepGoingError.
+const summaryLogLines = 10
+
+// BuildError is returned when the command of a build node exits with a non-zero status.
+type BuildError struct {
+	Target   string
+	Command  string
+	ExitCode int64
+
+	// Log holds the combined stdout and stderr of the build command.
+	Log string
+}
+
+func (e *BuildError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("build of %s failed: command %q exited with status %d", e.Target, e.Command, e.ExitCode))
+
+	if tail := e.LogTail(logTailLines); tail != "" {
+		sb.WriteString("\n")
+		sb.WriteString(tail)
+	}
+	return sb.String()
+}
+
+// LogTail returns the last n lines of the build log.
+func (e *BuildError) LogTail(n int) string {
+	lines := strings.Split(strings.TrimRight(e.Log, "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NodeFailure is a node that failed in keep-going mode.
+type NodeFailure struct {
+	Target string
+	Err    error
+
+	// Skipped lists the targets that were not built because they depend on Target.
+	Skipped []string
+}
+
+// KeepGoingError is returned by BuildAll in keep-going mode when nodes failed. Every
+// node that is not listed as failed or skipped was built.
+type KeepGoingError struct {
+	Failures []NodeFailure
+
+	// Total is the number of nodes that had to be built and SkippedCount the number
+	// of them that were skipped.
+	Total        int
+	SkippedCount int
+}
+
+// Blocked reports whether target failed or was skipped because of a failure.
+func (e *KeepGoingError) Blocked(target string) bool {
+	for _, failure := range e.Failures {
+		if failure.Target == target {
+			return true
+		}
+		for _, skipped := range failure.Skipped {
+			if skipped == target {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (e *KeepGoingError) Error() string {
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("%d of %d nodes failed, %d more skipped because of them:", len(e.Failures), e.Total, e.SkippedCount))
+
+	for _, failure := range e.Failures {
+		sb.WriteString("\n\nFAILED ")
+		sb.WriteString(failure.Target)
+
+		var buildErr *BuildError
+		if errors.As(failure.Err, &buildErr) {
+			sb.WriteString(fmt.Sprintf(": command %q exited with status %d", buildErr.Command, buildErr.ExitCode))
+			if tail := buildErr.LogTail(summaryLogLines); tail != "" {
+				sb.WriteString("\n    ")
+				sb.WriteString(strings.ReplaceAll(tail, "\n", "\n    "))
+			}
+		} else {
+			sb.WriteString(": ")
+			sb.WriteString(failure.Err.Error())
+		}
+
+		if len(failure.Skipped) > 0 {
+			sb.WriteString("\n  skipped because of it: ")
+			sb.WriteString(strings.Join(failure.Skipped, ", "))
+		}
+	}
+	return sb.String()
+}
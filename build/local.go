@@ -0,0 +1,120 @@
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// LocalExecutor runs build commands directly on the host, without a Docker daemon.
+// Every node gets a fresh temporary directory that only contains its declared inputs,
+// so a command cannot pick up files it did not declare as dependencies.
+type LocalExecutor struct{}
+
+func NewLocalExecutor() *LocalExecutor {
+	return &LocalExecutor{}
+}
+
+func (e *LocalExecutor) Execute(ctx context.Context, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, error) {
+	args := strings.Fields(build.Info.BuildCommand)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no build command for %s", build.TargetFilePath)
+	}
+
+	sandboxDir, err := os.MkdirTemp("", "build-sandbox-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sandbox for build %s: %w", build.TargetFilePath, err)
+	}
+	defer os.RemoveAll(sandboxDir)
+
+	for _, input := range inputs {
+		inputFile, err := sandboxPath(sandboxDir, input.TargetPath)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := c.WriteEntry(input, inputFile); err != nil {
+			return nil, fmt.Errorf("failed to copy dependency %s to sandbox: %w", input.TargetPath, err)
+		}
+	}
+
+	fmt.Printf("Building %s locally with command: %s\n", build.TargetFilePath, build.Info.BuildCommand)
+
+	workingDir, err := sandboxPath(sandboxDir, build.Info.WorkingDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(workingDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create working directory for build %s: %w", build.TargetFilePath, err)
+	}
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Dir = workingDir
+	cmd.Env = []string{
+		"PATH=" + os.Getenv("PATH"),
+		"HOME=" + sandboxDir,
+		"TMPDIR=" + sandboxDir,
+	}
+
+	log, err := cmd.CombinedOutput()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, &BuildError{
+				Target:   build.TargetFilePath,
+				Command:  build.Info.BuildCommand,
+				ExitCode: int64(exitErr.ExitCode()),
+				Log:      string(log),
+			}
+		}
+		return nil, fmt.Errorf("failed to run build command for %s: %w", build.TargetFilePath, err)
+	}
+
+	if len(log) > 0 {
+		fmt.Printf("Output of %s:\n%s", build.TargetFilePath, log)
+	}
+
+	fmt.Printf("Build completed for %s\n", build.TargetFilePath)
+
+	var outputs []cache.FileCacheEntry
+	for _, output := range build.Info.DeclaredOutputs(build.TargetFilePath) {
+		outputPath, err := sandboxPath(sandboxDir, output.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		if output.IsDirectory {
+			tree, err := c.PutDirectory(output.Path, outputPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read output directory %s: %w", output.Path, err)
+			}
+			outputs = append(outputs, tree)
+			continue
+		}
+
+		entry, err := c.PutFile(output.Path, outputPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read output file %s: %w", output.Path, err)
+		}
+		outputs = append(outputs, entry)
+	}
+
+	return outputs, nil
+}
+
+// sandboxPath maps a target path to its location inside the sandbox directory.
+// Paths that would escape the sandbox are rejected.
+func sandboxPath(sandboxDir string, targetPath string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(targetPath, "/")))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s points outside of the build sandbox", targetPath)
+	}
+	return filepath.Join(sandboxDir, rel), nil
+}
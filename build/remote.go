@@ -0,0 +1,281 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/cache"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// DefaultRemotePath is the PATH build commands run with on the remote executor. It is
+// the PATH of the official Debian based images like gcc, since remote workers do not
+// pass on the PATH of the image or of the worker.
+const DefaultRemotePath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// RemoteExecutor runs build nodes on a build farm implementing the Bazel Remote Execution
+// API (e.g. Buildbarn or BuildGrid). The inputs of a node are uploaded to the farm's CAS
+// as a Merkle tree, the action is executed remotely in the node's docker image, and the
+// outputs are downloaded into the local cache.
+type RemoteExecutor struct {
+	conn         *grpc.ClientConn
+	instanceName string
+
+	// path is the PATH build commands run with, or empty to not set one.
+	path string
+
+	execution  repb.ExecutionClient
+	cas        repb.ContentAddressableStorageClient
+	byteStream bspb.ByteStreamClient
+}
+
+// NewRemoteExecutor connects to the REAPI endpoint at target (host:port).
+func NewRemoteExecutor(target string, instanceName string) (*RemoteExecutor, error) {
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to remote executor %s: %w", target, err)
+	}
+
+	return &RemoteExecutor{
+		conn:         conn,
+		instanceName: instanceName,
+		path:         DefaultRemotePath,
+
+		execution:  repb.NewExecutionClient(conn),
+		cas:        repb.NewContentAddressableStorageClient(conn),
+		byteStream: bspb.NewByteStreamClient(conn),
+	}, nil
+}
+
+// SetPath sets the PATH build commands run with. An empty path leaves it unset.
+func (e *RemoteExecutor) SetPath(path string) {
+	e.path = path
+}
+
+func (e *RemoteExecutor) Close() error {
+	return e.conn.Close()
+}
+
+func (e *RemoteExecutor) Execute(ctx context.Context, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, error) {
+	args := strings.Fields(build.Info.BuildCommand)
+	if len(args) == 0 {
+		return nil, fmt.Errorf("no build command for %s", build.TargetFilePath)
+	}
+
+	blobs := newBlobSet()
+
+	inputRoot, err := buildInputRoot(inputs, c, blobs)
+	if err != nil {
+		return nil, fmt.Errorf("failed to build input root for %s: %w", build.TargetFilePath, err)
+	}
+
+	outputs := build.Info.DeclaredOutputs(build.TargetFilePath)
+	command := &repb.Command{
+		Arguments:        args,
+		Platform:         remotePlatform(build),
+		WorkingDirectory: remotePath(build.Info.WorkingDir),
+	}
+	if e.path != "" {
+		command.EnvironmentVariables = []*repb.Command_EnvironmentVariable{{Name: "PATH", Value: e.path}}
+	}
+	// Output paths are relative to the working directory, like the paths the command uses.
+	for _, output := range outputs {
+		outputPath := build.Info.CommandPath(output.Path)
+		command.OutputPaths = append(command.OutputPaths, outputPath)
+		if output.IsDirectory {
+			command.OutputDirectories = append(command.OutputDirectories, outputPath)
+		} else {
+			command.OutputFiles = append(command.OutputFiles, outputPath)
+		}
+	}
+	sort.Strings(command.OutputPaths)
+	sort.Strings(command.OutputFiles)
+	sort.Strings(command.OutputDirectories)
+
+	commandDigest, err := blobs.addMessage(command)
+	if err != nil {
+		return nil, err
+	}
+
+	action := &repb.Action{
+		CommandDigest:   commandDigest,
+		InputRootDigest: inputRoot,
+		Platform:        command.Platform,
+	}
+	actionDigest, err := blobs.addMessage(action)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := e.uploadMissingBlobs(ctx, blobs); err != nil {
+		return nil, fmt.Errorf("failed to upload inputs of %s: %w", build.TargetFilePath, err)
+	}
+
+	fmt.Printf("Building %s remotely with command: %s\n", build.TargetFilePath, build.Info.BuildCommand)
+
+	result, err := e.execute(ctx, actionDigest)
+	if err != nil {
+		return nil, fmt.Errorf("remote execution of %s failed: %w", build.TargetFilePath, err)
+	}
+
+	log, err := e.readLog(ctx, result)
+	if err != nil {
+		return nil, err
+	}
+
+	if result.GetExitCode() != 0 {
+		return nil, &BuildError{
+			Target:   build.TargetFilePath,
+			Command:  build.Info.BuildCommand,
+			ExitCode: int64(result.GetExitCode()),
+			Log:      log,
+		}
+	}
+
+	if log != "" {
+		fmt.Printf("Output of %s:\n%s", build.TargetFilePath, log)
+	}
+
+	fmt.Printf("Build completed for %s\n", build.TargetFilePath)
+
+	var entries []cache.FileCacheEntry
+	for _, output := range outputs {
+		entry, err := e.downloadOutput(ctx, result, output.Path, build.Info.CommandPath(output.Path), output.IsDirectory, c)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download output %s of %s: %w", output.Path, build.TargetFilePath, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// remotePlatform selects the docker image of the node using the platform property
+// understood by Buildbarn and BuildGrid workers.
+func remotePlatform(build *buildgraph.BuildGraphNode) *repb.Platform {
+	if build.Info.DockerImage == "" {
+		return nil
+	}
+	return &repb.Platform{
+		Properties: []*repb.Platform_Property{
+			{Name: "container-image", Value: "docker://" + build.Info.DockerImage},
+		},
+	}
+}
+
+// remotePath converts a target path to a path relative to the input root.
+func remotePath(targetPath string) string {
+	return strings.TrimPrefix(path.Clean("/"+targetPath), "/")
+}
+
+// execute runs the action and waits for its result.
+func (e *RemoteExecutor) execute(ctx context.Context, actionDigest *repb.Digest) (*repb.ActionResult, error) {
+	stream, err := e.execution.Execute(ctx, &repb.ExecuteRequest{
+		InstanceName: e.instanceName,
+		ActionDigest: actionDigest,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		op, err := stream.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if !op.GetDone() {
+			continue
+		}
+
+		if opErr := op.GetError(); opErr != nil {
+			return nil, status.ErrorProto(opErr)
+		}
+
+		var response repb.ExecuteResponse
+		if err := op.GetResponse().UnmarshalTo(&response); err != nil {
+			return nil, fmt.Errorf("invalid execute response: %w", err)
+		}
+
+		if s := response.GetStatus(); s != nil && codes.Code(s.GetCode()) != codes.OK {
+			return nil, status.ErrorProto(s)
+		}
+		if response.GetResult() == nil {
+			return nil, fmt.Errorf("execute response has no result")
+		}
+		return response.GetResult(), nil
+	}
+}
+
+// readLog returns the combined stdout and stderr of an executed action.
+func (e *RemoteExecutor) readLog(ctx context.Context, result *repb.ActionResult) (string, error) {
+	var log strings.Builder
+
+	for _, stream := range []struct {
+		raw    []byte
+		digest *repb.Digest
+	}{
+		{result.GetStdoutRaw(), result.GetStdoutDigest()},
+		{result.GetStderrRaw(), result.GetStderrDigest()},
+	} {
+		if len(stream.raw) > 0 {
+			log.Write(stream.raw)
+			continue
+		}
+		if stream.digest.GetSizeBytes() == 0 {
+			continue
+		}
+
+		data, err := e.downloadBlob(ctx, stream.digest)
+		if err != nil {
+			return "", fmt.Errorf("failed to download build log: %w", err)
+		}
+		log.Write(data)
+	}
+
+	return log.String(), nil
+}
+
+// downloadOutput fetches the output at outputPath, which the action result names want,
+// and returns its cache entry. The files of a directory output are stored in c directly.
+func (e *RemoteExecutor) downloadOutput(ctx context.Context, result *repb.ActionResult, outputPath string, want string, isDirectory bool, c *cache.Cache) (cache.FileCacheEntry, error) {
+	if !isDirectory {
+		for _, file := range result.GetOutputFiles() {
+			if file.GetPath() != want {
+				continue
+			}
+			d, err := e.downloadToCache(ctx, file.GetDigest(), c)
+			if err != nil {
+				return cache.FileCacheEntry{}, err
+			}
+			return cache.NewBlobTarget(outputPath, d), nil
+		}
+		return cache.FileCacheEntry{}, fmt.Errorf("action did not produce the output file")
+	}
+
+	for _, dir := range result.GetOutputDirectories() {
+		if dir.GetPath() != want {
+			continue
+		}
+
+		treeData, err := e.downloadBlob(ctx, dir.GetTreeDigest())
+		if err != nil {
+			return cache.FileCacheEntry{}, err
+		}
+
+		files, err := e.downloadTree(ctx, treeData, c)
+		if err != nil {
+			return cache.FileCacheEntry{}, err
+		}
+		return cache.NewTree(outputPath, files), nil
+	}
+	return cache.FileCacheEntry{}, fmt.Errorf("action did not produce the output directory")
+}
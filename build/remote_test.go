@@ -0,0 +1,565 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	longrunningpb "cloud.google.com/go/longrunning/autogen/longrunningpb"
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/cache"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// fakeREAPI is an in-process Remote Execution API server. It runs actions on the host
+// in a temporary directory, much like a Buildbarn worker without a container.
+type fakeREAPI struct {
+	repb.UnimplementedExecutionServer
+	repb.UnimplementedContentAddressableStorageServer
+	bspb.UnimplementedByteStreamServer
+
+	dir string
+
+	mu    sync.Mutex
+	blobs map[string][]byte
+}
+
+func (s *fakeREAPI) put(data []byte) *repb.Digest {
+	d := remoteDigest(data)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.blobs[d.GetHash()] = data
+	return d
+}
+
+func (s *fakeREAPI) get(d *repb.Digest) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exists := s.blobs[d.GetHash()]
+	if !exists {
+		return nil, status.Errorf(codes.NotFound, "blob %s not found", d.GetHash())
+	}
+	return data, nil
+}
+
+func (s *fakeREAPI) getMessage(d *repb.Digest, m proto.Message) error {
+	data, err := s.get(d)
+	if err != nil {
+		return err
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (s *fakeREAPI) FindMissingBlobs(ctx context.Context, req *repb.FindMissingBlobsRequest) (*repb.FindMissingBlobsResponse, error) {
+	resp := &repb.FindMissingBlobsResponse{}
+	for _, d := range req.GetBlobDigests() {
+		if _, err := s.get(d); err != nil {
+			resp.MissingBlobDigests = append(resp.MissingBlobDigests, d)
+		}
+	}
+	return resp, nil
+}
+
+func (s *fakeREAPI) BatchUpdateBlobs(ctx context.Context, req *repb.BatchUpdateBlobsRequest) (*repb.BatchUpdateBlobsResponse, error) {
+	resp := &repb.BatchUpdateBlobsResponse{}
+	for _, r := range req.GetRequests() {
+		code := codes.OK
+		if d := s.put(r.GetData()); d.GetHash() != r.GetDigest().GetHash() {
+			code = codes.InvalidArgument
+		}
+		resp.Responses = append(resp.Responses, &repb.BatchUpdateBlobsResponse_Response{
+			Digest: r.GetDigest(),
+			Status: status.New(code, "").Proto(),
+		})
+	}
+	return resp, nil
+}
+
+func (s *fakeREAPI) Read(req *bspb.ReadRequest, stream bspb.ByteStream_ReadServer) error {
+	parts := strings.Split(req.GetResourceName(), "/")
+	if len(parts) < 3 || parts[len(parts)-3] != "blobs" {
+		return status.Errorf(codes.InvalidArgument, "invalid resource name %s", req.GetResourceName())
+	}
+	data, err := s.get(&repb.Digest{Hash: parts[len(parts)-2]})
+	if err != nil {
+		return err
+	}
+
+	// Small chunks, so downloads have to put several messages together.
+	for offset := 0; offset < len(data); offset += 1000 {
+		end := min(offset+1000, len(data))
+		if err := stream.Send(&bspb.ReadResponse{Data: data[offset:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fakeREAPI) Write(stream bspb.ByteStream_WriteServer) error {
+	var resourceName string
+	var data []byte
+	for {
+		req, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		if req.GetResourceName() != "" {
+			resourceName = req.GetResourceName()
+		}
+		if req.GetWriteOffset() != int64(len(data)) {
+			return status.Errorf(codes.InvalidArgument, "write at offset %d, want %d", req.GetWriteOffset(), len(data))
+		}
+		data = append(data, req.GetData()...)
+		if req.GetFinishWrite() {
+			break
+		}
+	}
+
+	parts := strings.Split(resourceName, "/")
+	if len(parts) < 2 || parts[len(parts)-2] != remoteDigest(data).GetHash() {
+		return status.Errorf(codes.InvalidArgument, "data does not match resource name %s", resourceName)
+	}
+	s.put(data)
+	return stream.SendAndClose(&bspb.WriteResponse{CommittedSize: int64(len(data))})
+}
+
+func (s *fakeREAPI) Execute(req *repb.ExecuteRequest, stream grpc.ServerStreamingServer[longrunningpb.Operation]) error {
+	result, err := s.run(req.GetActionDigest())
+	if err != nil {
+		return status.Errorf(codes.FailedPrecondition, "%v", err)
+	}
+
+	response, err := anypb.New(&repb.ExecuteResponse{Result: result})
+	if err != nil {
+		return err
+	}
+	return stream.Send(&longrunningpb.Operation{
+		Name:   "operation",
+		Done:   true,
+		Result: &longrunningpb.Operation_Response{Response: response},
+	})
+}
+
+// run executes an action in a fresh directory and stores its outputs.
+func (s *fakeREAPI) run(actionDigest *repb.Digest) (*repb.ActionResult, error) {
+	var action repb.Action
+	if err := s.getMessage(actionDigest, &action); err != nil {
+		return nil, err
+	}
+	var command repb.Command
+	if err := s.getMessage(action.GetCommandDigest(), &command); err != nil {
+		return nil, err
+	}
+
+	root, err := os.MkdirTemp(s.dir, "action-")
+	if err != nil {
+		return nil, err
+	}
+	if err := s.writeDirectory(action.GetInputRootDigest(), root); err != nil {
+		return nil, err
+	}
+
+	// Like remote workers, the server passes on nothing but the variables of the command.
+	var env []string
+	pathEnv := ""
+	for _, v := range command.GetEnvironmentVariables() {
+		env = append(env, v.GetName()+"="+v.GetValue())
+		if v.GetName() == "PATH" {
+			pathEnv = v.GetValue()
+		}
+	}
+	program, err := lookPath(command.GetArguments()[0], pathEnv)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := exec.Command(program, command.GetArguments()[1:]...)
+	cmd.Dir = filepath.Join(root, filepath.FromSlash(command.GetWorkingDirectory()))
+	cmd.Env = env
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	result := &repb.ActionResult{}
+	if err := cmd.Run(); err != nil {
+		exitErr, ok := err.(*exec.ExitError)
+		if !ok {
+			return nil, err
+		}
+		result.ExitCode = int32(exitErr.ExitCode())
+	}
+	result.StdoutRaw = stdout.Bytes()
+	result.StderrDigest = s.put(stderr.Bytes())
+
+	// Output paths are relative to the working directory.
+	for _, outputPath := range command.GetOutputPaths() {
+		file := filepath.Join(cmd.Dir, filepath.FromSlash(outputPath))
+		info, err := os.Lstat(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if !info.IsDir() {
+			data, err := os.ReadFile(file)
+			if err != nil {
+				return nil, err
+			}
+			result.OutputFiles = append(result.OutputFiles, &repb.OutputFile{
+				Path:         outputPath,
+				Digest:       s.put(data),
+				IsExecutable: info.Mode()&0111 != 0,
+			})
+			continue
+		}
+
+		treeDigest, err := s.putTree(file)
+		if err != nil {
+			return nil, err
+		}
+		result.OutputDirectories = append(result.OutputDirectories, &repb.OutputDirectory{Path: outputPath, TreeDigest: treeDigest})
+	}
+	return result, nil
+}
+
+func lookPath(name string, pathEnv string) (string, error) {
+	for _, dir := range filepath.SplitList(pathEnv) {
+		file := filepath.Join(dir, name)
+		if info, err := os.Stat(file); err == nil && !info.IsDir() {
+			return file, nil
+		}
+	}
+	return "", fmt.Errorf("%s not found in PATH %q", name, pathEnv)
+}
+
+// writeDirectory lays out the Directory with digest d below dir.
+func (s *fakeREAPI) writeDirectory(d *repb.Digest, dir string) error {
+	var directory repb.Directory
+	if err := s.getMessage(d, &directory); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	for _, file := range directory.GetFiles() {
+		data, err := s.get(file.GetDigest())
+		if err != nil {
+			return err
+		}
+		mode := fs.FileMode(0644)
+		if file.GetIsExecutable() {
+			mode = 0755
+		}
+		if err := os.WriteFile(filepath.Join(dir, file.GetName()), data, mode); err != nil {
+			return err
+		}
+	}
+	for _, link := range directory.GetSymlinks() {
+		if err := os.Symlink(link.GetTarget(), filepath.Join(dir, link.GetName())); err != nil {
+			return err
+		}
+	}
+	for _, sub := range directory.GetDirectories() {
+		if err := s.writeDirectory(sub.GetDigest(), filepath.Join(dir, sub.GetName())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putTree stores the directory as a Tree message and returns its digest. The Directory
+// messages are encoded with their directories before their files, which is valid but
+// not the encoding the client would produce.
+func (s *fakeREAPI) putTree(dir string) (*repb.Digest, error) {
+	var children [][]byte
+
+	var encode func(dir string) ([]byte, error)
+	encode = func(dir string) ([]byte, error) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+
+		dirs := &repb.Directory{}
+		files := &repb.Directory{}
+		for _, entry := range entries {
+			file := filepath.Join(dir, entry.Name())
+			switch {
+			case entry.IsDir():
+				data, err := encode(file)
+				if err != nil {
+					return nil, err
+				}
+				children = append(children, data)
+				dirs.Directories = append(dirs.Directories, &repb.DirectoryNode{Name: entry.Name(), Digest: remoteDigest(data)})
+			case entry.Type()&fs.ModeSymlink != 0:
+				target, err := os.Readlink(file)
+				if err != nil {
+					return nil, err
+				}
+				files.Symlinks = append(files.Symlinks, &repb.SymlinkNode{Name: entry.Name(), Target: target})
+			default:
+				data, err := os.ReadFile(file)
+				if err != nil {
+					return nil, err
+				}
+				files.Files = append(files.Files, &repb.FileNode{Name: entry.Name(), Digest: s.put(data)})
+			}
+		}
+
+		dirsData, err := proto.Marshal(dirs)
+		if err != nil {
+			return nil, err
+		}
+		filesData, err := proto.Marshal(files)
+		if err != nil {
+			return nil, err
+		}
+		return append(dirsData, filesData...), nil
+	}
+
+	root, err := encode(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	tree := protowire.AppendTag(nil, 1, protowire.BytesType)
+	tree = protowire.AppendBytes(tree, root)
+	for _, child := range children {
+		tree = protowire.AppendTag(tree, 2, protowire.BytesType)
+		tree = protowire.AppendBytes(tree, child)
+	}
+	return s.put(tree), nil
+}
+
+// newFakeRemoteExecutor starts a fakeREAPI and returns a RemoteExecutor connected to it.
+func newFakeRemoteExecutor(t *testing.T) *RemoteExecutor {
+	t.Helper()
+
+	server := &fakeREAPI{dir: t.TempDir(), blobs: make(map[string][]byte)}
+	listener := bufconn.Listen(1024 * 1024)
+	s := grpc.NewServer()
+	repb.RegisterExecutionServer(s, server)
+	repb.RegisterContentAddressableStorageServer(s, server)
+	bspb.RegisterByteStreamServer(s, server)
+	go s.Serve(listener)
+	t.Cleanup(s.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///fake",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return &RemoteExecutor{
+		conn:       conn,
+		path:       os.Getenv("PATH"),
+		execution:  repb.NewExecutionClient(conn),
+		cas:        repb.NewContentAddressableStorageClient(conn),
+		byteStream: bspb.NewByteStreamClient(conn),
+	}
+}
+
+func TestRemoteExecutorRoundTrip(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	e := newFakeRemoteExecutor(t)
+	c := cache.NewCache(t.TempDir())
+
+	// A file larger than a BatchUpdateBlobs request, so it is streamed from the cache
+	// with ByteStream.
+	large := bytes.Repeat([]byte("0123456789abcdef"), maxBatchBytes/16+1)
+	bigFile, err := c.PutReader("big.txt", bytes.NewReader(large), int64(len(large)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := []byte("cat big.txt > out.txt\ncp -R src gen\nmkdir gen/empty\nln -s a.txt gen/link\necho done\n")
+
+	inputDir := t.TempDir()
+	for name, data := range map[string][]byte{"a.txt": []byte("a\n"), "sub/b.txt": []byte("b\n"), "sub/deeper/c.txt": []byte("c\n")} {
+		file := filepath.Join(inputDir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(file, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcTree, err := c.PutDirectory("src", inputDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inputs := []cache.FileCacheEntry{
+		cache.NewTarget("build.sh", script),
+		bigFile,
+		srcTree,
+	}
+
+	node := &buildgraph.BuildGraphNode{
+		TargetFilePath: "out.txt",
+		Info: buildinfo.Info{
+			BuildCommand: "sh build.sh",
+			Outputs:      []string{"out.txt", "gen/"},
+		},
+	}
+
+	outputs, err := e.Execute(context.Background(), node, inputs, c)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("got %d outputs, want 2", len(outputs))
+	}
+
+	if !outputs[0].IsBlob {
+		t.Errorf("out.txt is not stored as a blob")
+	}
+	data, err := c.ReadFile(outputs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, large) {
+		t.Errorf("out.txt has %d bytes, want the %d bytes of big.txt", len(data), len(large))
+	}
+
+	gen := outputs[1]
+	if !gen.IsTree {
+		t.Fatalf("gen is not a tree")
+	}
+	got := make(map[string]cache.TreeFile)
+	for _, file := range gen.Tree {
+		got[file.Path] = file
+	}
+	for _, name := range []string{"a.txt", "sub/b.txt", "sub/deeper/c.txt"} {
+		file, exists := got[name]
+		if !exists || !file.IsRegular() {
+			t.Errorf("gen/%s is missing", name)
+			continue
+		}
+		want, _ := os.ReadFile(filepath.Join(inputDir, filepath.FromSlash(name)))
+		if file.Digest != cache.DigestOf(want) {
+			t.Errorf("gen/%s has the wrong content", name)
+		}
+	}
+	if file, exists := got["link"]; !exists || !file.IsSymlink() || file.Link != "a.txt" {
+		t.Errorf("gen/link is %+v, want a symbolic link to a.txt", file)
+	}
+	if file, exists := got["empty"]; !exists || !file.IsDir() {
+		t.Errorf("gen/empty is %+v, want an empty directory", file)
+	}
+
+	restored := t.TempDir()
+	if err := c.WriteTree(gen, restored); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(restored, "sub", "b.txt"))
+	if err != nil || string(b) != "b\n" {
+		t.Errorf("restored gen/sub/b.txt is %q, %v", b, err)
+	}
+}
+
+func TestRemoteExecutorReportsExitCode(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	e := newFakeRemoteExecutor(t)
+	c := cache.NewCache(t.TempDir())
+
+	node := &buildgraph.BuildGraphNode{
+		TargetFilePath: "out.txt",
+		Info:           buildinfo.Info{BuildCommand: "sh fail.sh"},
+	}
+	inputs := []cache.FileCacheEntry{cache.NewTarget("fail.sh", []byte("echo broken >&2\nexit 3\n"))}
+
+	_, err := e.Execute(context.Background(), node, inputs, c)
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		t.Fatalf("Execute returned %v, want a BuildError", err)
+	}
+	if buildErr.ExitCode != 3 || !strings.Contains(buildErr.Log, "broken") {
+		t.Errorf("got exit code %d and log %q", buildErr.ExitCode, buildErr.Log)
+	}
+}
+
+func TestRemoteExecutorNeedsPath(t *testing.T) {
+	e := newFakeRemoteExecutor(t)
+	e.SetPath("")
+	c := cache.NewCache(t.TempDir())
+
+	node := &buildgraph.BuildGraphNode{
+		TargetFilePath: "out.txt",
+		Info:           buildinfo.Info{BuildCommand: "sh build.sh"},
+	}
+	_, err := e.Execute(context.Background(), node, []cache.FileCacheEntry{cache.NewTarget("build.sh", []byte("true\n"))}, c)
+	if err == nil || !strings.Contains(err.Error(), "not found in PATH") {
+		t.Errorf("Execute without PATH returned %v, want an error about PATH", err)
+	}
+}
+
+func TestRemoteExecutorWorkingDir(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	e := newFakeRemoteExecutor(t)
+	c := cache.NewCache(t.TempDir())
+
+	node := &buildgraph.BuildGraphNode{
+		TargetFilePath: "./lib/math/add.o",
+		Info: buildinfo.Info{
+			BuildCommand: "sh build.sh",
+			WorkingDir:   "lib/math",
+			Outputs:      []string{"./lib/math/add.o", "./lib/math/gen/"},
+		},
+	}
+	inputs := []cache.FileCacheEntry{
+		cache.NewTarget("./lib/math/build.sh", []byte("echo add > add.o\nmkdir gen\necho x > gen/x.txt\n")),
+	}
+
+	outputs, err := e.Execute(context.Background(), node, inputs, c)
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if len(outputs) != 2 {
+		t.Fatalf("got %d outputs, want 2", len(outputs))
+	}
+
+	data, err := c.ReadFile(outputs[0])
+	if err != nil || string(data) != "add\n" {
+		t.Errorf("lib/math/add.o is %q, %v, want %q", data, err, "add\n")
+	}
+	if len(outputs[1].Tree) != 1 || outputs[1].Tree[0].Path != "x.txt" {
+		t.Errorf("lib/math/gen is %+v, want x.txt", outputs[1].Tree)
+	}
+}
@@ -0,0 +1,581 @@
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/julebarn/BSc-build-systems/cache"
+	bspb "google.golang.org/genproto/googleapis/bytestream"
+	"google.golang.org/protobuf/encoding/protowire"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// maxBatchBytes bounds the payload of a single BatchUpdateBlobs request, well below
+	// the default gRPC message limit of 4 MiB. Larger blobs are sent over ByteStream.
+	maxBatchBytes = 2 * 1024 * 1024
+
+	// byteStreamChunk is the size of the chunks of a ByteStream upload.
+	byteStreamChunk = 1024 * 1024
+
+	// maxFindMissing bounds the number of digests in a single FindMissingBlobs request.
+	maxFindMissing = 10000
+)
+
+// remoteBlob is a blob an action needs in the CAS. Messages like Directory and Command
+// are held in memory, the files of the local cache are streamed from it when they are
+// uploaded.
+type remoteBlob struct {
+	digest *repb.Digest
+	data   []byte
+	open   func() (io.ReadCloser, error)
+}
+
+// reader returns the content of the blob.
+func (b remoteBlob) reader() (io.ReadCloser, error) {
+	if b.open == nil {
+		return io.NopCloser(bytes.NewReader(b.data)), nil
+	}
+	return b.open()
+}
+
+// blobSet collects the blobs an action needs in the CAS, keyed by hash.
+type blobSet struct {
+	blobs map[string]remoteBlob
+}
+
+func newBlobSet() *blobSet {
+	return &blobSet{blobs: make(map[string]remoteBlob)}
+}
+
+func (s *blobSet) add(data []byte) *repb.Digest {
+	d := remoteDigest(data)
+	s.blobs[d.GetHash()] = remoteBlob{digest: d, data: data}
+	return d
+}
+
+// addCached adds the blob with digest d of the local cache. name is the file it is the
+// content of.
+func (s *blobSet) addCached(c *cache.Cache, d cache.Digest, name string) (*repb.Digest, error) {
+	size, hit, err := c.BlobSize(d)
+	if err != nil {
+		return nil, err
+	}
+	if !hit {
+		return nil, fmt.Errorf("content of %s is missing from the cache", name)
+	}
+
+	digest := &repb.Digest{Hash: d.String(), SizeBytes: size}
+	s.blobs[digest.GetHash()] = remoteBlob{
+		digest: digest,
+		open: func() (io.ReadCloser, error) {
+			r, hit, err := c.OpenBlob(d)
+			if err == nil && !hit {
+				err = fmt.Errorf("content of %s is missing from the cache", name)
+			}
+			return r, err
+		},
+	}
+	return digest, nil
+}
+
+func (s *blobSet) addMessage(m proto.Message) (*repb.Digest, error) {
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(m)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %T: %w", m, err)
+	}
+	return s.add(data), nil
+}
+
+func remoteDigest(data []byte) *repb.Digest {
+	return &repb.Digest{
+		Hash:      cache.DigestOf(data).String(),
+		SizeBytes: int64(len(data)),
+	}
+}
+
+// inputDirectory is a directory of the input root while it is being assembled.
+type inputDirectory struct {
+	files    map[string]*repb.FileNode
+	symlinks map[string]*repb.SymlinkNode
+	dirs     map[string]*inputDirectory
+}
+
+func newInputDirectory() *inputDirectory {
+	return &inputDirectory{
+		files:    make(map[string]*repb.FileNode),
+		symlinks: make(map[string]*repb.SymlinkNode),
+		dirs:     make(map[string]*inputDirectory),
+	}
+}
+
+// isLeaf reports whether name is a file or symbolic link of dir.
+func (dir *inputDirectory) isLeaf(name string) bool {
+	_, isFile := dir.files[name]
+	_, isSymlink := dir.symlinks[name]
+	return isFile || isSymlink
+}
+
+// addDir returns the directory at dirPath below dir, creating it if needed.
+func (dir *inputDirectory) addDir(dirPath string) (*inputDirectory, error) {
+	if dirPath == "." || dirPath == "" {
+		return dir, nil
+	}
+
+	for _, part := range strings.Split(dirPath, "/") {
+		if dir.isLeaf(part) {
+			return nil, fmt.Errorf("%s is both a file and a directory", part)
+		}
+		sub, exists := dir.dirs[part]
+		if !exists {
+			sub = newInputDirectory()
+			dir.dirs[part] = sub
+		}
+		dir = sub
+	}
+	return dir, nil
+}
+
+// addLeaf returns the directory a file or symbolic link at filePath is added to, and
+// its name.
+func (dir *inputDirectory) addLeaf(filePath string) (*inputDirectory, string, error) {
+	parent, err := dir.addDir(path.Dir(filePath))
+	if err != nil {
+		return nil, "", err
+	}
+
+	name := path.Base(filePath)
+	if _, isDir := parent.dirs[name]; isDir {
+		return nil, "", fmt.Errorf("%s is both a file and a directory", filePath)
+	}
+	return parent, name, nil
+}
+
+func (dir *inputDirectory) addFile(filePath string, digest *repb.Digest, isExecutable bool) error {
+	parent, name, err := dir.addLeaf(filePath)
+	if err != nil {
+		return err
+	}
+	parent.files[name] = &repb.FileNode{Name: name, Digest: digest, IsExecutable: isExecutable}
+	return nil
+}
+
+func (dir *inputDirectory) addSymlink(filePath string, target string) error {
+	parent, name, err := dir.addLeaf(filePath)
+	if err != nil {
+		return err
+	}
+	parent.symlinks[name] = &repb.SymlinkNode{Name: name, Target: target}
+	return nil
+}
+
+// digest stores the Merkle tree below dir in blobs and returns the digest of dir.
+func (dir *inputDirectory) digest(blobs *blobSet) (*repb.Digest, error) {
+	directory := &repb.Directory{}
+
+	for _, name := range sortedKeys(dir.files) {
+		directory.Files = append(directory.Files, dir.files[name])
+	}
+
+	for _, name := range sortedKeys(dir.dirs) {
+		d, err := dir.dirs[name].digest(blobs)
+		if err != nil {
+			return nil, err
+		}
+		directory.Directories = append(directory.Directories, &repb.DirectoryNode{Name: name, Digest: d})
+	}
+
+	for _, name := range sortedKeys(dir.symlinks) {
+		directory.Symlinks = append(directory.Symlinks, dir.symlinks[name])
+	}
+
+	return blobs.addMessage(directory)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// buildInputRoot lays out the inputs of an action as a Merkle tree of Directory
+// messages and returns the digest of the root directory.
+func buildInputRoot(inputs []cache.FileCacheEntry, c *cache.Cache, blobs *blobSet) (*repb.Digest, error) {
+	root := newInputDirectory()
+
+	for _, input := range inputs {
+		inputPath := remotePath(input.TargetPath)
+
+		if !input.IsTree {
+			var digest *repb.Digest
+			if input.IsBlob {
+				var err error
+				digest, err = blobs.addCached(c, input.HashFile, input.TargetPath)
+				if err != nil {
+					return nil, err
+				}
+			} else {
+				digest = blobs.add(input.File)
+			}
+			if err := root.addFile(inputPath, digest, false); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if _, err := root.addDir(inputPath); err != nil {
+			return nil, err
+		}
+
+		for _, file := range input.Tree {
+			filePath := path.Join(inputPath, file.Path)
+			if file.IsSymlink() {
+				if err := root.addSymlink(filePath, file.Link); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			if file.IsDir() {
+				if _, err := root.addDir(filePath); err != nil {
+					return nil, err
+				}
+				continue
+			}
+
+			digest, err := blobs.addCached(c, file.Digest, path.Join(input.TargetPath, file.Path))
+			if err != nil {
+				return nil, err
+			}
+
+			isExecutable := file.Mode&0111 != 0
+			if err := root.addFile(filePath, digest, isExecutable); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return root.digest(blobs)
+}
+
+// uploadMissingBlobs uploads every blob of the set the CAS does not have yet.
+func (e *RemoteExecutor) uploadMissingBlobs(ctx context.Context, blobs *blobSet) error {
+	var digests []*repb.Digest
+	for _, blob := range blobs.blobs {
+		digests = append(digests, blob.digest)
+	}
+
+	var missing []*repb.Digest
+	for start := 0; start < len(digests); start += maxFindMissing {
+		end := min(start+maxFindMissing, len(digests))
+		resp, err := e.cas.FindMissingBlobs(ctx, &repb.FindMissingBlobsRequest{
+			InstanceName: e.instanceName,
+			BlobDigests:  digests[start:end],
+		})
+		if err != nil {
+			return fmt.Errorf("FindMissingBlobs failed: %w", err)
+		}
+		missing = append(missing, resp.GetMissingBlobDigests()...)
+	}
+
+	var batch []*repb.BatchUpdateBlobsRequest_Request
+	batchBytes := 0
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		resp, err := e.cas.BatchUpdateBlobs(ctx, &repb.BatchUpdateBlobsRequest{
+			InstanceName: e.instanceName,
+			Requests:     batch,
+		})
+		if err != nil {
+			return fmt.Errorf("BatchUpdateBlobs failed: %w", err)
+		}
+		for _, r := range resp.GetResponses() {
+			if r.GetStatus().GetCode() != 0 {
+				return fmt.Errorf("failed to upload blob %s: %s", r.GetDigest().GetHash(), r.GetStatus().GetMessage())
+			}
+		}
+		batch = nil
+		batchBytes = 0
+		return nil
+	}
+
+	for _, d := range missing {
+		blob := blobs.blobs[d.GetHash()]
+		r, err := blob.reader()
+		if err != nil {
+			return err
+		}
+
+		if d.GetSizeBytes() > maxBatchBytes {
+			err := e.writeBlob(ctx, d, r)
+			r.Close()
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		// Blobs that fit into a batch are small enough to be read into memory.
+		data, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read blob %s: %w", d.GetHash(), err)
+		}
+
+		if batchBytes+len(data) > maxBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, &repb.BatchUpdateBlobsRequest_Request{Digest: d, Data: data})
+		batchBytes += len(data)
+	}
+
+	return flush()
+}
+
+// writeBlob uploads a single blob with the ByteStream API, reading it from r in chunks.
+func (e *RemoteExecutor) writeBlob(ctx context.Context, d *repb.Digest, r io.Reader) error {
+	uploadID := make([]byte, 16)
+	if _, err := rand.Read(uploadID); err != nil {
+		return err
+	}
+	resourceName := fmt.Sprintf("uploads/%s/blobs/%s/%d", hex.EncodeToString(uploadID), d.GetHash(), d.GetSizeBytes())
+	if e.instanceName != "" {
+		resourceName = e.instanceName + "/" + resourceName
+	}
+
+	stream, err := e.byteStream.Write(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", d.GetHash(), err)
+	}
+
+	buf := make([]byte, byteStreamChunk)
+	for offset := int64(0); ; {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), d.GetSizeBytes()-offset)])
+		if err != nil {
+			return fmt.Errorf("failed to read blob %s: %w", d.GetHash(), err)
+		}
+
+		req := &bspb.WriteRequest{
+			WriteOffset: offset,
+			Data:        buf[:n],
+			FinishWrite: offset+int64(n) == d.GetSizeBytes(),
+		}
+		if offset == 0 {
+			req.ResourceName = resourceName
+		}
+		// Send encodes the request before it returns, so buf can be reused.
+		if err := stream.Send(req); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to upload blob %s: %w", d.GetHash(), err)
+		}
+		offset += int64(n)
+		if req.FinishWrite {
+			break
+		}
+	}
+
+	// Reading to the end verifies the content that was read from the cache.
+	if _, err := io.Copy(io.Discard, r); err != nil {
+		return fmt.Errorf("failed to read blob %s: %w", d.GetHash(), err)
+	}
+
+	if _, err := stream.CloseAndRecv(); err != nil {
+		return fmt.Errorf("failed to upload blob %s: %w", d.GetHash(), err)
+	}
+	return nil
+}
+
+// openBlob starts reading a blob from the CAS with the ByteStream API. Closing the
+// reader stops the download.
+func (e *RemoteExecutor) openBlob(ctx context.Context, d *repb.Digest) (io.ReadCloser, error) {
+	if d.GetSizeBytes() == 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+
+	resourceName := fmt.Sprintf("blobs/%s/%d", d.GetHash(), d.GetSizeBytes())
+	if e.instanceName != "" {
+		resourceName = e.instanceName + "/" + resourceName
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	stream, err := e.byteStream.Read(ctx, &bspb.ReadRequest{ResourceName: resourceName})
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed to download blob %s: %w", d.GetHash(), err)
+	}
+	return &byteStreamReader{stream: stream, cancel: cancel}, nil
+}
+
+// byteStreamReader reads the chunks of a ByteStream download.
+type byteStreamReader struct {
+	stream bspb.ByteStream_ReadClient
+	cancel context.CancelFunc
+	chunk  []byte
+}
+
+func (r *byteStreamReader) Read(p []byte) (int, error) {
+	for len(r.chunk) == 0 {
+		resp, err := r.stream.Recv()
+		if err != nil {
+			return 0, err
+		}
+		r.chunk = resp.GetData()
+	}
+
+	n := copy(p, r.chunk)
+	r.chunk = r.chunk[n:]
+	return n, nil
+}
+
+func (r *byteStreamReader) Close() error {
+	r.cancel()
+	return nil
+}
+
+// downloadBlob reads a small blob, like a Tree message or a build log, from the CAS
+// into memory and checks its digest.
+func (e *RemoteExecutor) downloadBlob(ctx context.Context, d *repb.Digest) ([]byte, error) {
+	r, err := e.openBlob(ctx, d)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download blob %s: %w", d.GetHash(), err)
+	}
+
+	if got := remoteDigest(data); got.GetHash() != d.GetHash() || got.GetSizeBytes() != d.GetSizeBytes() {
+		return nil, fmt.Errorf("downloaded blob %s does not match its digest", d.GetHash())
+	}
+	return data, nil
+}
+
+// downloadToCache streams a blob from the CAS into the local cache and checks its digest.
+func (e *RemoteExecutor) downloadToCache(ctx context.Context, d *repb.Digest, c *cache.Cache) (cache.Digest, error) {
+	r, err := e.openBlob(ctx, d)
+	if err != nil {
+		return cache.Digest{}, err
+	}
+	defer r.Close()
+
+	got, size, err := c.PutBlobFrom(r, d.GetSizeBytes())
+	if err != nil {
+		return cache.Digest{}, fmt.Errorf("failed to download blob %s: %w", d.GetHash(), err)
+	}
+	if got.String() != d.GetHash() || size != d.GetSizeBytes() {
+		return cache.Digest{}, fmt.Errorf("downloaded blob %s does not match its digest", d.GetHash())
+	}
+	return got, nil
+}
+
+// downloadTree downloads every file of an output directory described by a Tree message
+// into the local cache and returns the files of the directory.
+func (e *RemoteExecutor) downloadTree(ctx context.Context, treeData []byte, c *cache.Cache) ([]cache.TreeFile, error) {
+	var tree repb.Tree
+	if err := proto.Unmarshal(treeData, &tree); err != nil {
+		return nil, fmt.Errorf("invalid output tree: %w", err)
+	}
+
+	children, err := treeChildren(treeData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid output tree: %w", err)
+	}
+
+	var files []cache.TreeFile
+
+	var walk func(dir *repb.Directory, prefix string) error
+	walk = func(dir *repb.Directory, prefix string) error {
+		for _, file := range dir.GetFiles() {
+			d, err := e.downloadToCache(ctx, file.GetDigest(), c)
+			if err != nil {
+				return err
+			}
+
+			mode := fs.FileMode(0644)
+			if file.GetIsExecutable() {
+				mode = 0755
+			}
+			files = append(files, cache.TreeFile{Path: path.Join(prefix, file.GetName()), Mode: mode, Digest: d})
+		}
+
+		for _, link := range dir.GetSymlinks() {
+			files = append(files, cache.TreeFile{Path: path.Join(prefix, link.GetName()), Mode: fs.ModeSymlink | 0777, Link: link.GetTarget()})
+		}
+
+		if prefix != "" && len(dir.GetFiles()) == 0 && len(dir.GetSymlinks()) == 0 && len(dir.GetDirectories()) == 0 {
+			files = append(files, cache.TreeFile{Path: prefix, Mode: fs.ModeDir | 0755})
+		}
+
+		for _, sub := range dir.GetDirectories() {
+			child, exists := children[sub.GetDigest().GetHash()]
+			if !exists {
+				return fmt.Errorf("output tree is missing directory %s", path.Join(prefix, sub.GetName()))
+			}
+			if err := walk(child, path.Join(prefix, sub.GetName())); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(tree.GetRoot(), ""); err != nil {
+		return nil, err
+	}
+	return files, nil
+}
+
+// treeChildren returns the child directories of an encoded Tree message by the digest
+// of their encoding. The digests in DirectoryNodes are those of the bytes the server
+// encoded, which another encoder may not reproduce, e.g. with another field order, so
+// the children are hashed as they were received.
+func treeChildren(treeData []byte) (map[string]*repb.Directory, error) {
+	childrenField := (&repb.Tree{}).ProtoReflect().Descriptor().Fields().ByName("children").Number()
+
+	children := make(map[string]*repb.Directory)
+	for b := treeData; len(b) > 0; {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		if num != childrenField || typ != protowire.BytesType {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+			if n < 0 {
+				return nil, protowire.ParseError(n)
+			}
+			b = b[n:]
+			continue
+		}
+
+		data, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		child := &repb.Directory{}
+		if err := proto.Unmarshal(data, child); err != nil {
+			return nil, err
+		}
+		children[remoteDigest(data).GetHash()] = child
+	}
+	return children, nil
+}
@@ -0,0 +1,145 @@
+package build
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+type buildResult struct {
+	node *buildgraph.BuildGraphNode
+	err  error
+}
+
+// BuildAll builds every node in the graph that is not served from the cache.
+// The graph is walked as a DAG: a node is started as soon as all of its dependencies
+// have been built, and at most jobs nodes are built at the same time.
+//
+// The first failing node stops the scheduling of new nodes; the nodes that are
+// already running are allowed to finish before the error is returned. In keep-going
+// mode every node that does not depend on a failed one is still built, and the
+// failures are returned together as a *KeepGoingError.
+func (env *BuildEnvironment) BuildAll(graph *buildgraph.BuildGraph, c *cache.Cache, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	pending := make(map[*buildgraph.BuildGraphNode]int)
+	dependents := make(map[*buildgraph.BuildGraphNode][]*buildgraph.BuildGraphNode)
+	var ready []*buildgraph.BuildGraphNode
+	total := 0
+
+	for _, node := range graph.Nodes() {
+		if node.FromCache {
+			continue
+		}
+		total++
+
+		seen := make(map[*buildgraph.BuildGraphNode]bool)
+		for _, dep := range node.Dependencies {
+			if dep.FromCache || seen[dep] {
+				continue
+			}
+			seen[dep] = true
+			pending[node]++
+			dependents[dep] = append(dependents[dep], node)
+		}
+
+		if pending[node] == 0 {
+			ready = append(ready, node)
+		}
+	}
+
+	results := make(chan buildResult)
+	running := 0
+	finished := 0
+	var firstErr error
+	var failed []buildResult
+
+	for {
+		for firstErr == nil && running < jobs && len(ready) > 0 {
+			node := ready[0]
+			ready = ready[1:]
+			running++
+
+			go func(node *buildgraph.BuildGraphNode) {
+				results <- buildResult{node: node, err: env.Build(node, c)}
+			}(node)
+		}
+
+		if running == 0 {
+			break
+		}
+
+		result := <-results
+		running--
+		finished++
+
+		if result.err != nil {
+			// The dependents of a failed node never become ready, so they are skipped.
+			if env.keepGoing {
+				failed = append(failed, result)
+				continue
+			}
+			if firstErr == nil {
+				firstErr = fmt.Errorf("failed to build %s: %w", result.node.TargetFilePath, result.err)
+			}
+			continue
+		}
+
+		for _, dependent := range dependents[result.node] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if len(failed) > 0 {
+		return newKeepGoingError(failed, dependents, total)
+	}
+
+	if finished != total {
+		return fmt.Errorf("build stopped after %d of %d nodes: the remaining nodes have unbuildable dependencies", finished, total)
+	}
+
+	return nil
+}
+
+// newKeepGoingError lists the failed nodes together with the nodes skipped because
+// they depend on them, directly or through other skipped nodes.
+func newKeepGoingError(failed []buildResult, dependents map[*buildgraph.BuildGraphNode][]*buildgraph.BuildGraphNode, total int) *KeepGoingError {
+	e := &KeepGoingError{Total: total}
+	skipped := make(map[*buildgraph.BuildGraphNode]bool)
+
+	for _, result := range failed {
+		failure := NodeFailure{Target: result.node.TargetFilePath, Err: result.err}
+
+		seen := make(map[*buildgraph.BuildGraphNode]bool)
+		stack := append([]*buildgraph.BuildGraphNode{}, dependents[result.node]...)
+		for len(stack) > 0 {
+			node := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			if seen[node] {
+				continue
+			}
+			seen[node] = true
+			skipped[node] = true
+			failure.Skipped = append(failure.Skipped, node.TargetFilePath)
+			stack = append(stack, dependents[node]...)
+		}
+
+		sort.Strings(failure.Skipped)
+		e.Failures = append(e.Failures, failure)
+	}
+
+	sort.Slice(e.Failures, func(i, j int) bool { return e.Failures[i].Target < e.Failures[j].Target })
+	e.SkippedCount = len(skipped)
+	return e
+}
@@ -0,0 +1,265 @@
+package build
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/julebarn/BSc-build-systems/buildgraph"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// fakeExecutor records how BuildAll runs the nodes instead of running their commands.
+type fakeExecutor struct {
+	// delay is how long every node takes to build.
+	delay time.Duration
+
+	// fail lists the targets whose build fails. If failFirst is set, the first node
+	// to be built fails as well.
+	fail      map[string]bool
+	failFirst bool
+
+	// release, if set, blocks every node that does not fail until it is closed.
+	release chan struct{}
+
+	mu         sync.Mutex
+	running    int
+	maxRunning int
+	started    []string
+	finished   map[string]bool
+
+	// failed is closed once the first failing node has returned.
+	failed     chan struct{}
+	failedOnce sync.Once
+
+	// early lists the nodes that were started before one of their dependencies finished.
+	early []string
+}
+
+func newFakeExecutor() *fakeExecutor {
+	return &fakeExecutor{
+		fail:     make(map[string]bool),
+		finished: make(map[string]bool),
+		failed:   make(chan struct{}),
+	}
+}
+
+func (e *fakeExecutor) Execute(ctx context.Context, build *buildgraph.BuildGraphNode, inputs []cache.FileCacheEntry, c *cache.Cache) ([]cache.FileCacheEntry, error) {
+	e.mu.Lock()
+	fail := e.fail[build.TargetFilePath] || (e.failFirst && len(e.started) == 0)
+	e.started = append(e.started, build.TargetFilePath)
+	e.running++
+	if e.running > e.maxRunning {
+		e.maxRunning = e.running
+	}
+	for _, dep := range build.Dependencies {
+		if !e.finished[dep.TargetFilePath] {
+			e.early = append(e.early, build.TargetFilePath)
+		}
+	}
+	e.mu.Unlock()
+
+	if fail {
+		e.mu.Lock()
+		e.running--
+		e.mu.Unlock()
+		e.failedOnce.Do(func() { close(e.failed) })
+		return nil, &BuildError{Target: build.TargetFilePath, Command: build.BuildCommand, ExitCode: 1, Log: "broken\n"}
+	}
+
+	time.Sleep(e.delay)
+	if e.release != nil {
+		<-e.release
+	}
+
+	e.mu.Lock()
+	e.running--
+	e.finished[build.TargetFilePath] = true
+	e.mu.Unlock()
+
+	return []cache.FileCacheEntry{cache.NewTarget(build.TargetFilePath, []byte(build.TargetFilePath))}, nil
+}
+
+// newTestGraph returns a build graph with a node for every target in deps that depends
+// on the targets listed for it, and an environment that builds them with executor.
+func newTestGraph(t *testing.T, deps map[string][]string, executor Executor) (*BuildEnvironment, *buildgraph.BuildGraph) {
+	t.Helper()
+	graph := buildgraph.NewBuildGraph()
+	for target := range deps {
+		graph.MakeNode(target, buildinfo.Info{BuildCommand: "make " + target, Executor: "fake"})
+	}
+	for target, targetDeps := range deps {
+		node, _ := graph.Node(target)
+		for _, dep := range targetDeps {
+			depNode, ok := graph.Node(dep)
+			if !ok {
+				t.Fatalf("%s depends on unknown target %s", target, dep)
+			}
+			node.AddDependency(depNode)
+		}
+	}
+
+	env := &BuildEnvironment{
+		executors: map[string]Executor{"fake": executor},
+		ctx:       context.Background(),
+	}
+	return env, graph
+}
+
+func TestBuildAllJobs(t *testing.T) {
+	deps := make(map[string][]string)
+	for i := 0; i < 12; i++ {
+		deps[fmt.Sprintf("out%d", i)] = nil
+	}
+
+	for _, jobs := range []int{1, 3} {
+		t.Run(fmt.Sprintf("j%d", jobs), func(t *testing.T) {
+			executor := newFakeExecutor()
+			executor.delay = 20 * time.Millisecond
+			env, graph := newTestGraph(t, deps, executor)
+
+			if err := env.BuildAll(graph, cache.NewCache(t.TempDir()), jobs); err != nil {
+				t.Fatal(err)
+			}
+			if executor.maxRunning != jobs {
+				t.Errorf("%d nodes were built at the same time, want %d", executor.maxRunning, jobs)
+			}
+			if len(executor.finished) != len(deps) {
+				t.Errorf("%d of %d nodes were built", len(executor.finished), len(deps))
+			}
+		})
+	}
+}
+
+func TestBuildAllDependencies(t *testing.T) {
+	deps := map[string][]string{
+		"lib.a":  {"add.o", "sub.o", "mult.o"},
+		"add.o":  {"gen.h"},
+		"sub.o":  {"gen.h"},
+		"mult.o": nil,
+		"gen.h":  nil,
+		"calc":   {"lib.a", "main.o"},
+		"main.o": {"gen.h"},
+		"test":   {"calc", "add.o"},
+	}
+
+	executor := newFakeExecutor()
+	executor.delay = 5 * time.Millisecond
+	env, graph := newTestGraph(t, deps, executor)
+
+	if err := env.BuildAll(graph, cache.NewCache(t.TempDir()), 4); err != nil {
+		t.Fatal(err)
+	}
+	if len(executor.early) > 0 {
+		t.Errorf("started before their dependencies finished: %v", executor.early)
+	}
+	if len(executor.finished) != len(deps) {
+		t.Errorf("%d of %d nodes were built", len(executor.finished), len(deps))
+	}
+}
+
+func TestBuildAllFailFast(t *testing.T) {
+	deps := make(map[string][]string)
+	for i := 0; i < 6; i++ {
+		deps[fmt.Sprintf("out%d", i)] = nil
+	}
+
+	t.Run("no new nodes", func(t *testing.T) {
+		executor := newFakeExecutor()
+		executor.failFirst = true
+		env, graph := newTestGraph(t, deps, executor)
+
+		err := env.BuildAll(graph, cache.NewCache(t.TempDir()), 1)
+		if err == nil || !strings.Contains(err.Error(), "failed to build "+executor.started[0]) {
+			t.Fatalf("BuildAll returned %v, want the failure of %s", err, executor.started[0])
+		}
+		if len(executor.started) != 1 {
+			t.Errorf("nodes %v were started after the first one failed", executor.started[1:])
+		}
+	})
+
+	t.Run("running nodes finish", func(t *testing.T) {
+		executor := newFakeExecutor()
+		executor.failFirst = true
+		executor.release = make(chan struct{})
+		env, graph := newTestGraph(t, deps, executor)
+
+		// The other running node is released once the scheduler had time to see the failure.
+		go func() {
+			<-executor.failed
+			time.Sleep(50 * time.Millisecond)
+			close(executor.release)
+		}()
+
+		err := env.BuildAll(graph, cache.NewCache(t.TempDir()), 2)
+		if err == nil {
+			t.Fatal("BuildAll succeeded, want the failure")
+		}
+		if len(executor.started) != 2 {
+			t.Errorf("started %v, want only the two nodes running when the first failed", executor.started)
+		}
+		if len(executor.finished) != 1 {
+			t.Errorf("BuildAll returned before the running node finished")
+		}
+	})
+}
+
+func TestBuildAllKeepGoing(t *testing.T) {
+	deps := map[string][]string{
+		"bad.o":  nil,
+		"bad2.o": nil,
+		"add.o":  nil,
+		"sub.o":  nil,
+		"lib.a":  {"bad.o", "add.o"},
+		"calc":   {"lib.a", "sub.o"},
+		"tool":   {"bad2.o"},
+		"util":   {"add.o", "sub.o"},
+	}
+
+	executor := newFakeExecutor()
+	executor.fail["bad.o"] = true
+	executor.fail["bad2.o"] = true
+	env, graph := newTestGraph(t, deps, executor)
+	env.SetKeepGoing(true)
+
+	err := env.BuildAll(graph, cache.NewCache(t.TempDir()), 2)
+	keepGoingErr, ok := err.(*KeepGoingError)
+	if !ok {
+		t.Fatalf("BuildAll returned %v, want a KeepGoingError", err)
+	}
+
+	// The independent branches are built, the dependents of the failures are not.
+	for _, target := range []string{"add.o", "sub.o", "util"} {
+		if !executor.finished[target] {
+			t.Errorf("%s was not built", target)
+		}
+	}
+	for _, target := range []string{"lib.a", "calc", "tool"} {
+		if executor.finished[target] || !keepGoingErr.Blocked(target) {
+			t.Errorf("%s was not skipped", target)
+		}
+	}
+
+	if len(keepGoingErr.Failures) != 2 || keepGoingErr.SkippedCount != 3 || keepGoingErr.Total != len(deps) {
+		t.Errorf("got %d failures and %d of %d nodes skipped, want 2 failures and 3 of %d skipped",
+			len(keepGoingErr.Failures), keepGoingErr.SkippedCount, keepGoingErr.Total, len(deps))
+	}
+
+	// The error lists both failures with the nodes skipped because of them.
+	message := err.Error()
+	for _, want := range []string{
+		"2 of 8 nodes failed, 3 more skipped",
+		"FAILED bad.o: command \"make bad.o\" exited with status 1",
+		"skipped because of it: calc, lib.a",
+		"FAILED bad2.o",
+		"skipped because of it: tool",
+	} {
+		if !strings.Contains(message, want) {
+			t.Errorf("error does not contain %q:\n%s", want, message)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+// Package builddsl describes a build graph in Go code instead of build.json.
+//
+// A build program creates a Project, declares its sources and rules, and calls Main:
+//
+//	//go:build ignore
+//
+//	package main
+//
+//	import "github.com/julebarn/BSc-build-systems/builddsl"
+//
+//	func main() {
+//		p := builddsl.New()
+//		gcc := builddsl.GCC{}
+//		p.Source("./numbers.h")
+//		gcc.Binary(p, "./calc", p.Source("./calc.c", "./add.c"))
+//		p.Main()
+//	}
+//
+// Load runs such a program and returns the same graph build.json would describe.
+// Macros are ordinary Go functions that declare several rules, like GCC.Binary.
+package builddsl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/dependencygraph"
+)
+
+// Target is the path of a node, e.g. "./calc.o".
+type Target string
+
+// Project collects the nodes of a build graph.
+type Project struct {
+	nodes []dependencybuilder.DependencyGraphJSON
+	errs  []error
+}
+
+func New() *Project {
+	return &Project{}
+}
+
+// Source declares source files.
+func (p *Project) Source(paths ...string) []Target {
+	targets := make([]Target, 0, len(paths))
+	for _, path := range paths {
+		p.add(path, SourceFile(), nil)
+		targets = append(targets, Target(path))
+	}
+	return targets
+}
+
+// Glob declares a source file for every file matching one of patterns and none of
+// exclude, with the pattern syntax of globs in build.json.
+func (p *Project) Glob(patterns []string, exclude ...string) []Target {
+	files, err := dependencybuilder.Glob(".", patterns, exclude)
+	if err != nil {
+		p.errs = append(p.errs, fmt.Errorf("%s: %w", callerPosition(), err))
+		return nil
+	}
+	return p.Source(files...)
+}
+
+// Rule declares a target that is built by running info's build command on deps.
+func (p *Project) Rule(target string, info buildinfo.Info, deps ...Target) Target {
+	p.add(target, info, deps)
+	return Target(target)
+}
+
+func (p *Project) add(target string, info buildinfo.Info, deps []Target) {
+	node := dependencybuilder.DependencyGraphJSON{
+		TargetFilePath: target,
+		IsSourceFile:   info.IsSourceFile,
+		DockerImage:    info.DockerImage,
+		BuildCommand:   info.BuildCommand,
+		OutputFilePath: info.OutputFilePath,
+		Executor:       info.Executor,
+		Outputs:        info.Outputs,
+		Pos:            callerPosition(),
+	}
+	for _, dep := range deps {
+		node.Dependencies = append(node.Dependencies, string(dep))
+	}
+	p.nodes = append(p.nodes, node)
+}
+
+// Nodes returns the declared nodes in the form of build.json.
+func (p *Project) Nodes() []dependencybuilder.DependencyGraphJSON {
+	return p.nodes
+}
+
+// Graph validates the project and adds its nodes to a new dependency graph.
+func (p *Project) Graph() (*dependencygraph.DependencyGraphBuilder, error) {
+	if err := errors.Join(p.errs...); err != nil {
+		return nil, err
+	}
+	return dependencybuilder.BuildDependencyGraph(p.nodes)
+}
+
+// Main is called at the end of a build program. It validates the project and writes its
+// nodes to stdout for Load; problems are reported with the line that declared the node.
+func (p *Project) Main() {
+	if err := errors.Join(p.errs...); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := dependencybuilder.Validate(p.nodes); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	nodes := make([]programNode, 0, len(p.nodes))
+	for _, node := range p.nodes {
+		nodes = append(nodes, programNode{DependencyGraphJSON: node, File: node.Pos.File, Line: node.Pos.Line})
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "    ")
+	if err := enc.Encode(nodes); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to write build graph: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// programNode is a node as Main writes it for Run. Besides the fields of build.json it
+// has the position of the line that declared it, so Run can report problems with it.
+type programNode struct {
+	dependencybuilder.DependencyGraphJSON
+	File string `json:"file,omitempty"`
+	Line int    `json:"line,omitempty"`
+}
+
+// callerPosition returns the position of the first caller outside of this package,
+// which is the line of the build program that declared a node.
+func callerPosition() dependencybuilder.Position {
+	pcs := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(2, pcs)])
+	for {
+		frame, more := frames.Next()
+		if !strings.HasPrefix(frame.Function, "github.com/julebarn/BSc-build-systems/builddsl.") {
+			return dependencybuilder.Position{File: frame.File, Line: frame.Line}
+		}
+		if !more {
+			return dependencybuilder.Position{}
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package builddsl
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/dependencygraph"
+)
+
+// Load runs the build program at programPath with go run and returns the graph it
+// describes. The program is run in its own directory, so it declares the same
+// paths a build.json next to it would. The directory must belong to a Go module that
+// can resolve the import of this package, e.g. one that requires
+// github.com/julebarn/BSc-build-systems.
+func Load(programPath string) (*dependencygraph.DependencyGraphBuilder, error) {
+	nodes, err := Run(programPath)
+	if err != nil {
+		return nil, err
+	}
+	return dependencybuilder.BuildDependencyGraph(nodes)
+}
+
+// Run runs the build program at programPath like Load and returns the nodes it declares.
+func Run(programPath string) ([]dependencybuilder.DependencyGraphJSON, error) {
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.Command("go", "run", filepath.Base(programPath))
+	cmd.Dir = filepath.Dir(programPath)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("build program %s failed: %w\n%s", programPath, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var programNodes []programNode
+	if err := json.Unmarshal(stdout.Bytes(), &programNodes); err != nil {
+		return nil, fmt.Errorf("build program %s did not write a build graph: %w", programPath, err)
+	}
+
+	nodes := make([]dependencybuilder.DependencyGraphJSON, 0, len(programNodes))
+	for _, programNode := range programNodes {
+		node := programNode.DependencyGraphJSON
+		node.Pos = dependencybuilder.Position{File: programNode.File, Line: programNode.Line}
+		if node.Pos.File == "" {
+			node.Pos.File = programPath
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
@@ -0,0 +1,106 @@
+package builddsl
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+// SourceFile returns the build info of a source file, which is read from the project
+// instead of being built.
+func SourceFile() buildinfo.Info {
+	return buildinfo.Info{
+		IsSourceFile: true,
+	}
+}
+
+// Gcc returns the build info of a gcc command run in the gcc docker image.
+func Gcc(cmd string) buildinfo.Info {
+	return buildinfo.Info{
+		IsSourceFile:   false,
+		DockerImage:    "gcc:latest",
+		BuildCommand:   "gcc " + cmd,
+		OutputFilePath: "",
+	}
+}
+
+// GccLink returns the build info of linking inputFiles into outputFile with gcc.
+func GccLink(outputFile string, inputFiles ...string) buildinfo.Info {
+	return buildinfo.Info{
+		IsSourceFile:   false,
+		DockerImage:    "gcc:latest",
+		BuildCommand:   fmt.Sprintf("gcc -o %s %s", outputFile, strings.Join(inputFiles, " ")),
+		OutputFilePath: outputFile,
+	}
+}
+
+// GCC is a toolchain that compiles and links C or C++ with gcc or a compatible compiler.
+// The zero value uses gcc in the gcc:latest docker image.
+type GCC struct {
+	// Compiler is the compiler command, "gcc" if empty.
+	Compiler string
+
+	// Image is the docker image the compiler runs in, "gcc:latest" if empty.
+	Image string
+
+	// Executor selects the executor of the rules; empty selects the default.
+	Executor string
+
+	CFlags  []string
+	LDFlags []string
+}
+
+func (tc GCC) info(args ...string) buildinfo.Info {
+	compiler := tc.Compiler
+	if compiler == "" {
+		compiler = "gcc"
+	}
+	image := tc.Image
+	if image == "" {
+		image = "gcc:latest"
+	}
+
+	return buildinfo.Info{
+		DockerImage:  image,
+		BuildCommand: strings.Join(append([]string{compiler}, args...), " "),
+		Executor:     tc.Executor,
+	}
+}
+
+// Compile declares the object file of source, e.g. "./calc.o" for "./calc.c".
+// Headers are discovered by the compiler; deps only need to list other inputs.
+func (tc GCC) Compile(p *Project, source Target, deps ...Target) Target {
+	object := strings.TrimSuffix(string(source), path.Ext(string(source))) + ".o"
+
+	args := append([]string{}, tc.CFlags...)
+	args = append(args, "-c", commandPath(source), "-o", commandPath(Target(object)))
+
+	return p.Rule(object, tc.info(args...), append([]Target{source}, deps...)...)
+}
+
+// Link declares the program output linked from objects.
+func (tc GCC) Link(p *Project, output string, objects ...Target) Target {
+	args := []string{"-o", commandPath(Target(output))}
+	for _, object := range objects {
+		args = append(args, commandPath(object))
+	}
+	args = append(args, tc.LDFlags...)
+
+	return p.Rule(output, tc.info(args...), objects...)
+}
+
+// Binary is a macro that compiles every source and links the objects into output.
+func (tc GCC) Binary(p *Project, output string, sources []Target, deps ...Target) Target {
+	objects := make([]Target, 0, len(sources))
+	for _, source := range sources {
+		objects = append(objects, tc.Compile(p, source, deps...))
+	}
+	return tc.Link(p, output, objects...)
+}
+
+// commandPath returns the path of a target as it is written in a build command.
+func commandPath(target Target) string {
+	return buildinfo.RelativePath(string(target))
+}
@@ -23,6 +23,21 @@ func (bg *BuildGraph) MakeNode(targetFilePath string, info buildinfo.Info) *Buil
 	return node
 }
 
+// Node returns the node for targetFilePath if it has already been added to the graph.
+func (bg *BuildGraph) Node(targetFilePath string) (*BuildGraphNode, bool) {
+	node, exists := bg.nodes[targetFilePath]
+	return node, exists
+}
+
+// Nodes returns every node in the graph, in no particular order.
+func (bg *BuildGraph) Nodes() []*BuildGraphNode {
+	nodes := make([]*BuildGraphNode, 0, len(bg.nodes))
+	for _, node := range bg.nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
 type BuildGraphNode struct {
 	TargetFilePath string
 	FromCache      bool
@@ -39,6 +54,7 @@ func (node *BuildGraphNode) AddDependency(dep *BuildGraphNode) {
 func (bg *BuildGraph) CalculateBuildOrder() []*BuildGraphNode {
 	// This function uses topological sort to determine the build order of the nodes.
 	// since this is a directed acyclic graph (DAG), we can use DFS-based approach.
+	// (cycles are rejected by the dependency graph before a build graph is made from it)
 
 	visited := make(map[string]bool)
 
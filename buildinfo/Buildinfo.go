@@ -1,5 +1,11 @@
 package buildinfo
 
+import (
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
 
 type Info struct {
 	IsSourceFile bool `json:"is_source_file,omitempty"`
@@ -7,4 +13,106 @@ type Info struct {
 	DockerImage    string `json:"docker_image,omitempty"`
 	BuildCommand   string `json:"build_command,omitempty"`
 	OutputFilePath string `json:"output_file_path,omitempty"`
+
+	// Outputs lists every file written by the build command. The first output is the
+	// file of the node itself, every further output is addressable as its own target.
+	// Outputs ending in a slash are directories that are captured as a whole.
+	Outputs []string `json:"outputs,omitempty"`
+
+	// ProducedBy is set on the nodes of additional outputs and names the target
+	// whose build command writes the file.
+	ProducedBy string `json:"produced_by,omitempty"`
+
+	// Executor selects how the build command is run, e.g. "docker" or "local".
+	// Nodes without an executor are built with docker.
+	Executor string `json:"executor,omitempty"`
+
+	// WorkingDir is the directory the build command runs in, relative to the workspace
+	// root, e.g. "lib/math" for the nodes of the package //lib/math. Paths in the build
+	// command are relative to it; the outputs are still named from the root.
+	WorkingDir string `json:"working_dir,omitempty"`
+}
+
+// Output is a file or directory written by a build command.
+type Output struct {
+	Path        string
+	IsDirectory bool
+}
+
+// DeclaredOutputs returns all files and directories written by the build command of the
+// node with the given target. The first output is the output of the node itself.
+func (info Info) DeclaredOutputs(target string) []Output {
+	if len(info.Outputs) > 0 {
+		outputs := make([]Output, 0, len(info.Outputs))
+		for _, output := range info.Outputs {
+			outputs = append(outputs, Output{
+				Path:        strings.TrimSuffix(output, "/"),
+				IsDirectory: strings.HasSuffix(output, "/"),
+			})
+		}
+		return outputs
+	}
+	if info.OutputFilePath != "" {
+		return []Output{{Path: info.OutputFilePath}}
+	}
+	return []Output{{Path: target}}
+}
+
+// compilers are the C and C++ compilers whose header dependencies are discovered from
+// the depfile they write with -MD.
+var compilers = map[string]bool{
+	"cc":      true,
+	"c++":     true,
+	"gcc":     true,
+	"g++":     true,
+	"clang":   true,
+	"clang++": true,
+}
+
+// DiscoversHeaders reports whether the build command compiles C or C++ source with gcc
+// or clang. The headers read by such a command are discovered from a depfile, so they
+// do not have to be listed as dependencies.
+func (info Info) DiscoversHeaders() bool {
+	args := strings.Fields(info.BuildCommand)
+	if len(args) == 0 {
+		return false
+	}
+
+	// Versioned compilers like gcc-13 or clang++-17 are treated like the plain ones.
+	compiler := strings.TrimRight(path.Base(args[0]), "-.0123456789")
+	if !compilers[compiler] {
+		return false
+	}
+	return slices.Contains(args[1:], "-c")
+}
+
+// IsHeaderFile reports whether the file at filePath is a C or C++ header.
+func IsHeaderFile(filePath string) bool {
+	switch path.Ext(filePath) {
+	case ".h", ".hh", ".hpp", ".hxx", ".h++", ".inc", ".ipp", ".tcc":
+		return true
+	}
+	return false
+}
+
+// RelativePath returns filePath as a clean slash separated path relative to the project
+// root, e.g. "numbers.h" for "./numbers.h". Discovered inputs are recorded in this form.
+func RelativePath(filePath string) string {
+	return path.Clean(strings.TrimPrefix(filePath, "/"))
+}
+
+// WorkspacePath returns a path that the build command names relative to its working
+// directory as a path relative to the workspace root, in the form of RelativePath.
+func (info Info) WorkspacePath(filePath string) string {
+	return RelativePath(path.Join(info.WorkingDir, filePath))
+}
+
+// CommandPath returns the path of a target as the build command names it, relative to
+// its working directory, e.g. "add.o" for "./lib/math/add.o" in "lib/math".
+func (info Info) CommandPath(targetPath string) string {
+	rel, err := filepath.Rel(filepath.FromSlash(RelativePath(info.WorkingDir)), filepath.FromSlash(RelativePath(targetPath)))
+	if err != nil {
+		return RelativePath(targetPath)
+	}
+	return filepath.ToSlash(rel)
 }
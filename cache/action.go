@@ -0,0 +1,495 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/structpb"
+)
+
+// Digest is the SHA-256 hash of a blob or of an action.
+type Digest [sha256.Size]byte
+
+func (d Digest) String() string {
+	return hex.EncodeToString(d[:])
+}
+
+// DigestOf returns the content digest of data.
+func DigestOf(data []byte) Digest {
+	return sha256.Sum256(data)
+}
+
+// ActionInput is a file that is made available to an action, identified by
+// the path it is placed at and the digest of its content.
+type ActionInput struct {
+	Path   string
+	Digest Digest
+}
+
+// NewActionInput returns the action input for a cached file.
+func NewActionInput(entry FileCacheEntry) ActionInput {
+	return ActionInput{
+		Path:   entry.TargetPath,
+		Digest: entry.ContentDigest(),
+	}
+}
+
+// ActionResult is the outcome of running an action: the files it produced,
+// each stored as a content-addressed blob.
+type ActionResult struct {
+	Outputs []OutputFile
+
+	// DiscoveredInputs are the inputs the action reported to have read, see
+	// FileCacheEntry.DiscoveredInputs.
+	DiscoveredInputs    []string
+	HasDiscoveredInputs bool
+}
+
+// OutputFile is a single output of an action. For a directory output
+// Digest refers to the tree manifest stored with PutTreeManifest.
+type OutputFile struct {
+	Path   string
+	Digest Digest
+	IsTree bool
+}
+
+// ActionKey returns the key of the action described by info when it is run on inputs.
+// Two actions with the same key are expected to produce the same outputs, regardless
+// of the project or target they belong to.
+func ActionKey(info buildinfo.Info, inputs []ActionInput) (Digest, error) {
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return Digest{}, fmt.Errorf("failed to encode build info: %w", err)
+	}
+
+	sorted := make([]ActionInput, len(inputs))
+	copy(sorted, inputs)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	h := sha256.New()
+	h.Write(infoJSON)
+	for _, input := range sorted {
+		h.Write([]byte{0})
+		h.Write([]byte(input.Path))
+		h.Write([]byte{0})
+		h.Write(input.Digest[:])
+	}
+
+	var key Digest
+	copy(key[:], h.Sum(nil))
+	return key, nil
+}
+
+// DiscoveredActionKey returns the key of an action that reported which of its header
+// inputs it read. Headers it did not read cannot affect its outputs, so they are left
+// out of the key and adding or removing an unrelated header does not change it.
+func DiscoveredActionKey(info buildinfo.Info, inputs []ActionInput, discovered []string) (Digest, error) {
+	read := make(map[string]bool, len(discovered))
+	for _, input := range discovered {
+		read[input] = true
+	}
+
+	var used []ActionInput
+	for _, input := range inputs {
+		if buildinfo.IsHeaderFile(input.Path) && !read[buildinfo.RelativePath(input.Path)] {
+			continue
+		}
+		used = append(used, input)
+	}
+	return ActionKey(info, used)
+}
+
+func (c *Cache) actionFile(key Digest) string {
+	return filepath.Join(c.cacheDir, "ac", key.String())
+}
+
+// blobFile returns the file of the blob with digest d stored with codec.
+func (c *Cache) blobFile(d Digest, codec Codec) string {
+	return filepath.Join(c.cacheDir, "cas", d.String()+blobExt[codec])
+}
+
+// parseBlobName returns the digest and codec of the blob stored in the file name.
+func parseBlobName(name string) (Digest, Codec, bool) {
+	for codec, ext := range blobExt {
+		if ext == "" || !strings.HasSuffix(name, ext) {
+			continue
+		}
+		d, ok := parseDigest(strings.TrimSuffix(name, ext))
+		return d, codec, ok
+	}
+	d, ok := parseDigest(name)
+	return d, Raw, ok
+}
+
+func parseDigest(s string) (Digest, bool) {
+	var d Digest
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(d) {
+		return Digest{}, false
+	}
+	copy(d[:], b)
+	return d, true
+}
+
+// SetAction records the result of the action with the given key.
+// The blobs of all outputs must already have been stored with PutBlob.
+func (c *Cache) SetAction(key Digest, result ActionResult) error {
+	data, err := c.encodeActionResult(result)
+	if err != nil {
+		return fmt.Errorf("failed to encode action result %s: %w", key, err)
+	}
+
+	actionFile := c.actionFile(key)
+	if err := c.writeFile(actionFile, data); err != nil {
+		return fmt.Errorf("failed to write action cache file %s: %w", actionFile, err)
+	}
+
+	c.putRemote("ac", key, data)
+	return nil
+}
+
+// GetAction returns the recorded result of the action with the given key.
+// A result whose output blobs are no longer in the cache is reported as a miss.
+func (c *Cache) GetAction(key Digest) (ActionResult, bool, error) {
+	actionFile := c.actionFile(key)
+
+	data, err := os.ReadFile(actionFile)
+	local := err == nil
+	if os.IsNotExist(err) {
+		var hit bool
+		data, hit = c.getRemote("ac", key)
+		if !hit {
+			return ActionResult{}, false, nil
+		}
+
+		if err := c.writeFile(actionFile, data); err != nil {
+			return ActionResult{}, false, err
+		}
+	} else if err != nil {
+		return ActionResult{}, false, fmt.Errorf("failed to read action cache file %s: %w", actionFile, err)
+	}
+
+	result, err := decodeActionResult(data)
+	if err != nil {
+		c.quarantine(actionFile, data, err)
+		return ActionResult{}, false, nil
+	}
+
+	for _, output := range result.Outputs {
+		hit, err := c.hasBlob(output.Digest)
+		if err != nil || !hit {
+			return ActionResult{}, false, err
+		}
+	}
+
+	touch(actionFile)
+	if local {
+		c.shareAction(key, result)
+	}
+	return result, true, nil
+}
+
+// resultMetadataType is the type of the auxiliary metadata that records what the
+// ActionResult message cannot: the order of the outputs, whose first one is the target
+// of the action, and the inputs the action reported to have read.
+const resultMetadataType = "type.googleapis.com/google.protobuf.Struct"
+
+// encodeActionResult returns result as an ActionResult message of the remote execution
+// API, which Bazel cache servers expect and validate. A directory output refers to the
+// tree manifest of this cache rather than to a Tree message.
+func (c *Cache) encodeActionResult(result ActionResult) ([]byte, error) {
+	message := &repb.ActionResult{}
+	var order []interface{}
+	for _, output := range result.Outputs {
+		size, hit, err := c.BlobSize(output.Digest)
+		if err != nil {
+			return nil, err
+		}
+		if !hit {
+			return nil, fmt.Errorf("blob %s of output %s is missing from the cache", output.Digest, output.Path)
+		}
+
+		digest := &repb.Digest{Hash: output.Digest.String(), SizeBytes: size}
+		if output.IsTree {
+			message.OutputDirectories = append(message.OutputDirectories, &repb.OutputDirectory{Path: output.Path, TreeDigest: digest})
+		} else {
+			message.OutputFiles = append(message.OutputFiles, &repb.OutputFile{Path: output.Path, Digest: digest})
+		}
+		order = append(order, output.Path)
+	}
+
+	fields := map[string]interface{}{"outputs": order}
+	if result.HasDiscoveredInputs {
+		discovered := make([]interface{}, 0, len(result.DiscoveredInputs))
+		for _, input := range result.DiscoveredInputs {
+			discovered = append(discovered, input)
+		}
+		fields["discovered_inputs"] = discovered
+	}
+	metadata, err := structpb.NewStruct(fields)
+	if err != nil {
+		return nil, err
+	}
+	aux, err := anypb.New(metadata)
+	if err != nil {
+		return nil, err
+	}
+	message.ExecutionMetadata = &repb.ExecutedActionMetadata{AuxiliaryMetadata: []*anypb.Any{aux}}
+
+	return proto.Marshal(message)
+}
+
+// decodeActionResult parses an action result stored by encodeActionResult. Results
+// stored by older versions of this cache, which were gob encoded, are still read.
+func decodeActionResult(data []byte) (ActionResult, error) {
+	message := &repb.ActionResult{}
+	if err := proto.Unmarshal(data, message); err != nil {
+		var result ActionResult
+		if gobErr := gob.NewDecoder(bytes.NewReader(data)).Decode(&result); gobErr != nil {
+			return ActionResult{}, fmt.Errorf("failed to decode action result: %w", err)
+		}
+		return result, nil
+	}
+
+	outputs := make(map[string]OutputFile)
+	var paths []string
+	add := func(path string, digest *repb.Digest, isTree bool) error {
+		d, ok := parseDigest(digest.GetHash())
+		if !ok {
+			return fmt.Errorf("output %s has an invalid digest %q", path, digest.GetHash())
+		}
+		outputs[path] = OutputFile{Path: path, Digest: d, IsTree: isTree}
+		paths = append(paths, path)
+		return nil
+	}
+	for _, file := range message.OutputFiles {
+		if err := add(file.Path, file.Digest, false); err != nil {
+			return ActionResult{}, err
+		}
+	}
+	for _, dir := range message.OutputDirectories {
+		if err := add(dir.Path, dir.TreeDigest, true); err != nil {
+			return ActionResult{}, err
+		}
+	}
+
+	var result ActionResult
+	for _, aux := range message.GetExecutionMetadata().GetAuxiliaryMetadata() {
+		if aux.GetTypeUrl() != resultMetadataType {
+			continue
+		}
+		metadata := &structpb.Struct{}
+		if err := aux.UnmarshalTo(metadata); err != nil {
+			return ActionResult{}, fmt.Errorf("failed to decode action result metadata: %w", err)
+		}
+
+		if order, ok := metadata.Fields["outputs"]; ok {
+			paths = nil
+			for _, path := range order.GetListValue().GetValues() {
+				if _, ok := outputs[path.GetStringValue()]; !ok {
+					return ActionResult{}, fmt.Errorf("output %s is missing from the action result", path.GetStringValue())
+				}
+				paths = append(paths, path.GetStringValue())
+			}
+		}
+		if discovered, ok := metadata.Fields["discovered_inputs"]; ok {
+			result.HasDiscoveredInputs = true
+			for _, input := range discovered.GetListValue().GetValues() {
+				result.DiscoveredInputs = append(result.DiscoveredInputs, input.GetStringValue())
+			}
+		}
+	}
+
+	for _, path := range paths {
+		result.Outputs = append(result.Outputs, outputs[path])
+	}
+	return result, nil
+}
+
+// shareAction uploads an action result that was found in the local cache, and the blobs
+// it refers to, if the remote cache does not have it yet. Results built before the
+// remote cache was used, or while it was unreachable, become remote hits this way.
+func (c *Cache) shareAction(key Digest, result ActionResult) {
+	if c.remote == nil {
+		return
+	}
+
+	hit, err := c.remote.has("ac", key)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return
+	}
+	if hit {
+		return
+	}
+
+	// The blobs go first, so the remote result never refers to blobs it does not have.
+	for _, d := range c.resultRefs(result) {
+		if hit, err := c.remote.has("cas", d); err == nil && hit {
+			continue
+		}
+
+		size, hit, err := c.BlobSize(d)
+		if err != nil || !hit {
+			fmt.Printf("Warning: failed to upload blob %s: %v\n", d, err)
+			return
+		}
+		c.uploadBlob(d, size)
+	}
+
+	// The result is encoded again, so results stored by older versions are shared in
+	// the format Bazel cache servers expect.
+	data, err := c.encodeActionResult(result)
+	if err != nil {
+		fmt.Printf("Warning: failed to encode action result %s: %v\n", key, err)
+		return
+	}
+	c.putRemote("ac", key, data)
+}
+
+// PutBlob stores data in the content-addressed store and returns its digest.
+func (c *Cache) PutBlob(data []byte) (Digest, error) {
+	d := DigestOf(data)
+
+	// A stored copy is not read again; if it is corrupt, it is quarantined once it is read.
+	if c.reuseBlob(d) {
+		return d, nil
+	}
+
+	if err := c.writeBlob(d, data); err != nil {
+		return Digest{}, err
+	}
+
+	c.putRemote("cas", d, data)
+	return d, nil
+}
+
+// GetBlob returns the content of the blob with digest d. A blob that does not match
+// its digest is quarantined and downloaded again from the remote cache, if there is one.
+func (c *Cache) GetBlob(d Digest) ([]byte, bool, error) {
+	data, hit, err := c.readBlob(d)
+	if err != nil || hit {
+		return data, hit, err
+	}
+
+	data, hit = c.getRemote("cas", d)
+	if !hit {
+		return nil, false, nil
+	}
+	if DigestOf(data) != d {
+		return nil, false, fmt.Errorf("blob %s from remote cache does not match its digest", d)
+	}
+
+	if err := c.writeBlob(d, data); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+// readBlob returns the content of the local blob with digest d, verified against it.
+func (c *Cache) readBlob(d Digest) ([]byte, bool, error) {
+	r, hit, err := c.openLocalBlob(d)
+	if err != nil || !hit {
+		return nil, false, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	var corrupt *corruptError
+	if errors.As(err, &corrupt) {
+		// The blob has been quarantined.
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read blob %s: %w", d, err)
+	}
+	return data, true, nil
+}
+
+// reuseBlob reports whether the blob with digest d is stored locally, and records that
+// it was used. The shared lock keeps GC from removing the blob before it is recorded,
+// after which the grace period protects it.
+func (c *Cache) reuseBlob(d Digest) bool {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return false
+	}
+	defer unlock()
+
+	file, found := c.findBlob(d)
+	if found {
+		touch(file)
+	}
+	return found
+}
+
+// writeBlob stores the blob data with digest d, compressed with the codec of the cache.
+func (c *Cache) writeBlob(d Digest, data []byte) error {
+	codec, stored := encode(c.codec, data)
+	if err := c.writeFile(c.blobFile(d, codec), stored); err != nil {
+		return fmt.Errorf("failed to write blob %s: %w", d, err)
+	}
+	return nil
+}
+
+// findBlob returns the file of the blob with digest d if it is stored locally, with
+// any codec.
+func (c *Cache) findBlob(d Digest) (string, bool) {
+	for codec := range blobExt {
+		file := c.blobFile(d, codec)
+		if _, err := os.Stat(file); err == nil {
+			return file, true
+		}
+	}
+	return "", false
+}
+
+// hasBlob reports whether the blob with digest d is available, downloading it
+// from the remote cache if it is only stored there.
+func (c *Cache) hasBlob(d Digest) (bool, error) {
+	if file, found := c.findBlob(d); found {
+		touch(file)
+		return true, nil
+	}
+	return c.fetchBlob(d)
+}
+
+// writeCacheFile writes data to a temporary file and moves it into place once it is
+// complete, so an interrupted build never leaves a partial entry behind.
+func writeCacheFile(file string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
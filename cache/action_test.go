@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"reflect"
+	"testing"
+
+	repb "github.com/bazelbuild/remote-apis/build/bazel/remote/execution/v2"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestActionKey(t *testing.T) {
+	info := buildinfo.Info{DockerImage: "gcc:latest", BuildCommand: "gcc -c add.c -o add.o"}
+	inputs := []ActionInput{
+		{Path: "./add.c", Digest: DigestOf([]byte("int add(int a, int b) { return a + b; }"))},
+		{Path: "./numbers.h", Digest: DigestOf([]byte("#define ONE 1"))},
+	}
+
+	key, err := ActionKey(info, inputs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		info   buildinfo.Info
+		inputs []ActionInput
+		same   bool
+	}{
+		{
+			name:   "same action",
+			info:   info,
+			inputs: inputs,
+			same:   true,
+		},
+		{
+			name:   "inputs in another order",
+			info:   info,
+			inputs: []ActionInput{inputs[1], inputs[0]},
+			same:   true,
+		},
+		{
+			name:   "other command",
+			info:   buildinfo.Info{DockerImage: "gcc:latest", BuildCommand: "gcc -O2 -c add.c -o add.o"},
+			inputs: inputs,
+		},
+		{
+			name:   "other image",
+			info:   buildinfo.Info{DockerImage: "gcc:13", BuildCommand: info.BuildCommand},
+			inputs: inputs,
+		},
+		{
+			name:   "other input path",
+			info:   info,
+			inputs: []ActionInput{inputs[0], {Path: "./include/numbers.h", Digest: inputs[1].Digest}},
+		},
+		{
+			name:   "other input digest",
+			info:   info,
+			inputs: []ActionInput{inputs[0], {Path: inputs[1].Path, Digest: DigestOf([]byte("#define ONE 2"))}},
+		},
+		{
+			name:   "missing input",
+			info:   info,
+			inputs: inputs[:1],
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ActionKey(tt.info, tt.inputs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (got == key) != tt.same {
+				t.Errorf("ActionKey = %s, same as the original key: %v, want %v", got, got == key, tt.same)
+			}
+		})
+	}
+}
+
+func TestActionResultProto(t *testing.T) {
+	c := NewCache(t.TempDir())
+
+	header, err := c.PutBlob([]byte("int add(int, int);\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := c.PutTreeManifest([]TreeFile{{Path: "add.h", Mode: 0644, Digest: header}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	object, err := c.PutBlob([]byte("object"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The directory comes first, so the order is not the one of the message.
+	want := ActionResult{
+		Outputs: []OutputFile{
+			{Path: "include", Digest: manifest, IsTree: true},
+			{Path: "add.o", Digest: object},
+		},
+		DiscoveredInputs:    []string{"add.h"},
+		HasDiscoveredInputs: true,
+	}
+	key := DigestOf([]byte("action"))
+	if err := c.SetAction(key, want); err != nil {
+		t.Fatal(err)
+	}
+
+	// Bazel cache servers read the entry as an ActionResult message.
+	data, err := os.ReadFile(c.actionFile(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message repb.ActionResult
+	if err := proto.Unmarshal(data, &message); err != nil {
+		t.Fatalf("action result is not an ActionResult message: %v", err)
+	}
+	if len(message.OutputFiles) != 1 || message.OutputFiles[0].Path != "add.o" ||
+		message.OutputFiles[0].Digest.GetHash() != object.String() || message.OutputFiles[0].Digest.GetSizeBytes() != int64(len("object")) {
+		t.Errorf("OutputFiles = %v, want add.o with digest %s/6", message.OutputFiles, object)
+	}
+	if len(message.OutputDirectories) != 1 || message.OutputDirectories[0].Path != "include" ||
+		message.OutputDirectories[0].TreeDigest.GetHash() != manifest.String() {
+		t.Errorf("OutputDirectories = %v, want include with digest %s", message.OutputDirectories, manifest)
+	}
+
+	got, hit, err := c.GetAction(key)
+	if err != nil || !hit {
+		t.Fatalf("GetAction = %v, %v, want a hit", hit, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAction = %+v, want %+v", got, want)
+	}
+
+	// Results stored by older versions are still read.
+	var old bytes.Buffer
+	if err := gob.NewEncoder(&old).Encode(want); err != nil {
+		t.Fatal(err)
+	}
+	oldKey := DigestOf([]byte("old action"))
+	if err := writeCacheFile(c.actionFile(oldKey), old.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	got, hit, err = c.GetAction(oldKey)
+	if err != nil || !hit {
+		t.Fatalf("GetAction of a gob result = %v, %v, want a hit", hit, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("GetAction of a gob result = %+v, want %+v", got, want)
+	}
+}
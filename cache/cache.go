@@ -1,29 +1,41 @@
 package cache
 
 import (
-	"crypto/md5"
+	"bytes"
 	"encoding/gob"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 )
 
 type Cache struct {
 	cacheDir string
-}
 
-func NewCache(cacheDir string) *Cache {
+	// remote is consulted when an action result or blob is missing locally,
+	// and receives everything stored locally. It is nil when no remote cache is used.
+	remote *RemoteCache
 
-	_, err := os.Stat(cacheDir);
-	if os.IsNotExist(err) {
-		err := os.MkdirAll(cacheDir, 0755)
-		if err != nil {
-			panic(fmt.Sprintf("failed to create cache directory %s: %v", cacheDir, err))
-		}
-	}
+	// codec compresses the files and blobs written to the cache directory.
+	codec Codec
+}
 
+// NewCache returns the cache stored in cacheDir. The directory is created by the first
+// write, so commands that only read the cache do not leave an empty one behind.
+func NewCache(cacheDir string) *Cache {
 	return &Cache{
 		cacheDir: cacheDir,
+		codec:    Zstd,
+	}
+}
+
+// SetCompression selects whether new files and blobs are compressed on disk. Entries
+// are read the same way either way, so it can be changed for an existing cache.
+func (c *Cache) SetCompression(enabled bool) {
+	c.codec = Raw
+	if enabled {
+		c.codec = Zstd
 	}
 }
 
@@ -32,63 +44,192 @@ func (c *Cache) Set(path string, t FileCacheEntry) error {
 
 	cacheFile := c.cacheDir + "/" + string(pathHash[:])
 
-	// open or create the cache file
-	file, err := os.OpenFile(cacheFile, os.O_RDWR|os.O_CREATE, 0644)
-	if err != nil {
-		return fmt.Errorf("failed to open cache file %s: %w", cacheFile, err)
-	}
-	defer file.Close()
+	// Only the stored copy is compressed, Get returns the entry as it was given.
+	t.Codec, t.File = encode(c.codec, t.File)
 
-	err = gob.NewEncoder(file).Encode(t)
+	var buf bytes.Buffer
+	err := gob.NewEncoder(&buf).Encode(t)
 	if err != nil {
 		return fmt.Errorf("failed to encode cache file %s: %w", cacheFile, err)
 	}
 
+	// The entry replaces the previous one at once, so a failed or interrupted
+	// build never leaves a partially written entry behind.
+	if err := c.writeFile(cacheFile, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to write cache file %s: %w", cacheFile, err)
+	}
 
 	return nil
 }
 
 func (c *Cache) Get(path string) (FileCacheEntry, bool, error) {
-	fmt.Println("Getting cache for:", path)
-
 	pathHash := hex.EncodeToString([]byte(path))
 
 	cacheFile := c.cacheDir + "/" + string(pathHash[:])
 
-	file, err := os.Open(cacheFile)
+	data, err := os.ReadFile(cacheFile)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Println("Cache file does not exist:", cacheFile)
 			return FileCacheEntry{}, false, nil
 		}
 		return FileCacheEntry{}, false, fmt.Errorf("failed to open cache file %s: %w", cacheFile, err)
 	}
-	defer file.Close()
 
-	var t FileCacheEntry
-	err = gob.NewDecoder(file).Decode(&t)
+	t, err := decodeEntry(data, path)
 	if err != nil {
-		return FileCacheEntry{}, false, fmt.Errorf("failed to decode cache file %s: %w", cacheFile, err)
+		// A corrupt entry must not fail every build: the target is built again
+		// and replaces it.
+		c.quarantine(cacheFile, data, err)
+		return FileCacheEntry{}, false, nil
 	}
 
-	if t.TargetPath != path {
-		return FileCacheEntry{}, false, fmt.Errorf("cache file path mismatch: %s, expected: %s, got: %s", cacheFile, path, t.TargetPath)
+	// The entry is only useful while its content is available.
+	if t.IsBlob {
+		hit, err := c.hasBlob(t.HashFile)
+		if err != nil || !hit {
+			return FileCacheEntry{}, false, err
+		}
 	}
 
-	fmt.Println("Cache hit for:", path)
+	touch(cacheFile)
 	return t, true, nil
 }
 
 type FileCacheEntry struct {
 	TargetPath     string
-	HashFile [16]byte
+	HashFile Digest
 	File     []byte
+
+	// Codec is the encoding of File in the cache directory. Entries returned by
+	// Get are always decoded.
+	Codec Codec
+
+	// IsBlob is set for files whose content is stored as the blob HashFile, so it
+	// can be streamed instead of being held in memory. File is empty. Entries
+	// written by older versions hold their content in File.
+	IsBlob bool
+
+	// ActionKey is the key of the action that produced the file.
+	// It is zero for source files.
+	ActionKey Digest
+
+	// IsTree is set for directory artifacts. Their files are listed in Tree
+	// and stored as blobs, File is empty.
+	IsTree bool
+	Tree   []TreeFile
+
+	// DiscoveredInputs lists the inputs the producing action reported to have read,
+	// e.g. the headers in the depfile of a C compile, as paths relative to the project
+	// root. HasDiscoveredInputs tells an empty list apart from an action that does not
+	// report its inputs.
+	DiscoveredInputs    []string
+	HasDiscoveredInputs bool
+}
+
+// ContentDigest returns the digest identifying the content of the entry.
+// For a tree it covers the path, mode and content of every file.
+func (t FileCacheEntry) ContentDigest() Digest {
+	if t.IsTree {
+		return DigestOf(encodeTreeManifest(t.Tree))
+	}
+	if t.IsBlob {
+		return t.HashFile
+	}
+	return DigestOf(t.File)
+}
+
+// decodeEntry decodes the stored entry of the target at path and verifies it.
+func decodeEntry(data []byte, path string) (FileCacheEntry, error) {
+	var t FileCacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&t); err != nil {
+		return FileCacheEntry{}, err
+	}
+
+	file, err := decode(t.Codec, t.File)
+	if err != nil {
+		return FileCacheEntry{}, err
+	}
+	t.File, t.Codec = file, Raw
+
+	if err := t.verify(path); err != nil {
+		return FileCacheEntry{}, err
+	}
+	return t, nil
+}
+
+// verify checks that the entry is the one of the target at path and that its content
+// matches its hash.
+func (t FileCacheEntry) verify(path string) error {
+	if t.TargetPath != path {
+		return fmt.Errorf("entry of %s found instead of %s", t.TargetPath, path)
+	}
+	if t.HashFile != t.ContentDigest() {
+		return errors.New("content does not match its hash")
+	}
+	return nil
 }
 
 func NewTarget(path string, file []byte) FileCacheEntry {
 	return FileCacheEntry{
 		TargetPath:     path,
-		HashFile: md5.Sum(file),
+		HashFile: DigestOf(file),
 		File:     file,
 	}
 }
+
+// SetRemote layers the local cache on top of remote: action results and blobs missing
+// locally are read from remote, and new ones are written to both.
+func (c *Cache) SetRemote(remote *RemoteCache) {
+	c.remote = remote
+}
+
+// getRemote downloads from the remote cache. An unreachable remote cache is
+// treated as a miss, so builds keep working without it.
+func (c *Cache) getRemote(kind string, d Digest) ([]byte, bool) {
+	if c.remote == nil {
+		return nil, false
+	}
+	data, hit, err := c.remote.get(kind, d)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return nil, false
+	}
+	return data, hit
+}
+
+// putRemote uploads to the remote cache. A failed upload only costs other builds a
+// cache hit, so it is reported but does not fail the build.
+func (c *Cache) putRemote(kind string, d Digest, data []byte) {
+	if c.remote == nil {
+		return
+	}
+	if err := c.remote.put(kind, d, data); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// quarantine moves a corrupt cache file, read as data, into the quarantine directory of
+// the cache, where it no longer counts as an entry but can still be inspected.
+func (c *Cache) quarantine(file string, data []byte, reason error) {
+	c.quarantineIf(file, sameContent(data), reason)
+}
+
+// quarantineIf quarantines a corrupt cache file unless it was replaced since it was
+// checked.
+func (c *Cache) quarantineIf(file string, unchanged unchangedFunc, reason error) {
+	rel, err := filepath.Rel(c.cacheDir, file)
+	if err != nil {
+		rel = filepath.Base(file)
+	}
+	dest := filepath.Join(c.cacheDir, "quarantine", rel)
+
+	fmt.Printf("Warning: cache file %s is corrupt: %v\n", file, reason)
+	moved, err := c.removeUnchanged(file, unchanged, dest)
+	if err != nil {
+		fmt.Printf("Warning: failed to quarantine %s: %v\n", file, err)
+		return
+	}
+	if moved {
+		fmt.Printf("Moved it to %s\n", dest)
+	}
+}
@@ -0,0 +1,62 @@
+package cache
+
+import (
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec is the encoding of stored content. Every entry and blob records its codec, so
+// entries written with and without compression can be read side by side.
+type Codec string
+
+const (
+	// Raw stores content as it is. It is the codec of entries written before
+	// compression was supported.
+	Raw Codec = ""
+
+	// Zstd compresses content with Zstandard.
+	Zstd Codec = "zstd"
+)
+
+// blobExt is the file name extension of the blobs stored with each codec.
+var blobExt = map[Codec]string{
+	Raw:  "",
+	Zstd: ".zst",
+}
+
+// The encoder and decoder are safe for concurrent use with EncodeAll and DecodeAll.
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+// encode returns data encoded with codec, and the codec actually used: content that
+// does not get smaller, like files that are already compressed, is stored raw.
+func encode(codec Codec, data []byte) (Codec, []byte) {
+	if codec != Zstd || len(data) == 0 {
+		return Raw, data
+	}
+
+	compressed := zstdEncoder.EncodeAll(data, nil)
+	if len(compressed) >= len(data) {
+		return Raw, data
+	}
+	return Zstd, compressed
+}
+
+// decode returns the content that was encoded with codec.
+func decode(codec Codec, data []byte) ([]byte, error) {
+	switch codec {
+	case Raw:
+		return data, nil
+	case Zstd:
+		decoded, err := zstdDecoder.DecodeAll(data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress: %w", err)
+		}
+		return decoded, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %q", codec)
+	}
+}
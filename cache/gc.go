@@ -0,0 +1,408 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGracePeriod is the grace period of GC when none is given.
+const DefaultGracePeriod = time.Hour
+
+// GCOptions selects the entries removed by GC. Entries are evicted least recently
+// used first; the modification time of a cache file records when it was last used.
+type GCOptions struct {
+	// MaxSize is the number of bytes the cache may keep, zero for no limit.
+	MaxSize int64
+
+	// MaxAge removes the entries that were not used for longer, zero for no limit.
+	MaxAge time.Duration
+
+	// Reachable reports whether the target with the given path is still part of the
+	// build graph. If it is set, the entries of other targets are removed, together
+	// with the action results that no reachable target was built by and the blobs that
+	// no remaining entry refers to.
+	Reachable func(targetPath string) bool
+
+	// GracePeriod protects the entries used more recently, so a build that runs at the
+	// same time keeps the entries it has just read or written. Zero selects
+	// DefaultGracePeriod.
+	GracePeriod time.Duration
+
+	// DryRun only reports what would be removed.
+	DryRun bool
+}
+
+// GCStats reports the outcome of GC.
+type GCStats struct {
+	Removed      int
+	RemovedBytes int64
+	Kept         int
+	KeptBytes    int64
+}
+
+// gcEntry is a file of the cache directory.
+type gcEntry struct {
+	file    string
+	size    int64
+	used    time.Time
+	removed bool
+
+	// targetPath is set for the entry of a target, with the key of the action that
+	// produced it.
+	targetPath string
+	actionKey  Digest
+
+	// action is set for an action result, to the key of the action.
+	action *Digest
+
+	// blob is set for a blob, refs for the entries that refer to blobs.
+	blob *Digest
+	refs []Digest
+}
+
+// GC removes unused entries from the cache: the entries older than MaxAge, the
+// entries of unreachable targets and, as long as the cache is larger than MaxSize,
+// the least recently used ones. A blob is only removed once no remaining entry
+// refers to it, so every entry that survives can still be restored.
+func (c *Cache) GC(options GCOptions) (GCStats, error) {
+	grace := options.GracePeriod
+	if grace == 0 {
+		grace = DefaultGracePeriod
+	}
+	now := time.Now()
+
+	// Writes wait while the entries are scanned and removed, so GC decides on a
+	// consistent snapshot of the cache. The grace period protects what was written
+	// just before, e.g. the blobs of an action whose result is not recorded yet.
+	unlock, err := c.lock(true)
+	if err != nil {
+		return GCStats{}, err
+	}
+	defer unlock()
+
+	entries, temps, err := c.scanEntries()
+	if err != nil {
+		return GCStats{}, err
+	}
+
+	reachable := func(entry *gcEntry) bool {
+		return entry.targetPath != "" && options.Reachable != nil && options.Reachable(entry.targetPath)
+	}
+
+	// An action result is only worth keeping for a reachable target: one that was
+	// produced by the action, or that refers to one of its outputs, e.g. when the
+	// result is also recorded under the key of its declared inputs.
+	refCount := make(map[Digest]int)
+	targetRefCount := make(map[Digest]int)
+	actionUsers := make(map[Digest]int)
+	var total int64
+	for _, entry := range entries {
+		total += entry.size
+		for _, d := range entry.refs {
+			refCount[d]++
+		}
+		if reachable(entry) {
+			for _, d := range entry.refs {
+				targetRefCount[d]++
+			}
+			actionUsers[entry.actionKey]++
+		}
+	}
+	usedAction := func(entry *gcEntry) bool {
+		if actionUsers[*entry.action] > 0 {
+			return true
+		}
+		for _, d := range entry.refs {
+			if targetRefCount[d] > 0 {
+				return true
+			}
+		}
+		return false
+	}
+
+	var stats GCStats
+	remove := func(entry *gcEntry) error {
+		if !options.DryRun {
+			if err := os.Remove(entry.file); err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove cache file %s: %w", entry.file, err)
+			}
+		}
+		entry.removed = true
+		total -= entry.size
+		stats.Removed++
+		stats.RemovedBytes += entry.size
+		for _, d := range entry.refs {
+			refCount[d]--
+		}
+		if reachable(entry) {
+			for _, d := range entry.refs {
+				targetRefCount[d]--
+			}
+			actionUsers[entry.actionKey]--
+		}
+		return nil
+	}
+
+	// Temporary files are left behind by interrupted writes, quarantined files are
+	// only kept for inspection.
+	for _, temp := range temps {
+		if now.Sub(temp.used) > grace {
+			if err := remove(temp); err != nil {
+				return stats, err
+			}
+		}
+	}
+
+	// Least recently used first.
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].used.Before(entries[j].used) })
+
+	evict := func(entry *gcEntry) bool {
+		if options.MaxAge > 0 && now.Sub(entry.used) > options.MaxAge {
+			return true
+		}
+		if options.Reachable != nil {
+			if entry.targetPath != "" && !options.Reachable(entry.targetPath) {
+				return true
+			}
+			if entry.action != nil && !usedAction(entry) {
+				return true
+			}
+			if entry.blob != nil {
+				return true
+			}
+		}
+		return options.MaxSize > 0 && total > options.MaxSize
+	}
+
+	// Removing an entry can release blobs that were seen before, so the entries are
+	// walked until nothing more can be removed.
+	for progress := true; progress; {
+		progress = false
+		for _, entry := range entries {
+			if entry.removed || now.Sub(entry.used) <= grace || !evict(entry) {
+				continue
+			}
+			if entry.blob != nil && refCount[*entry.blob] > 0 {
+				continue
+			}
+			if err := remove(entry); err != nil {
+				return stats, err
+			}
+			progress = true
+		}
+	}
+
+	for _, entry := range entries {
+		if !entry.removed {
+			stats.Kept++
+			stats.KeptBytes += entry.size
+		}
+	}
+	return stats, nil
+}
+
+// scanEntries lists the entries of targets, the action results and the blobs of the
+// cache, and separately the temporary files of unfinished writes and the quarantined
+// files.
+func (c *Cache) scanEntries() (entries []*gcEntry, temps []*gcEntry, err error) {
+	scan := func(dir string, add func(entry *gcEntry, name string) error) error {
+		files, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read cache directory %s: %w", dir, err)
+		}
+
+		for _, file := range files {
+			if file.IsDir() {
+				continue
+			}
+			info, err := file.Info()
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			entry := &gcEntry{
+				file: filepath.Join(dir, file.Name()),
+				size: info.Size(),
+				used: info.ModTime(),
+			}
+			if strings.Contains(file.Name(), ".tmp-") {
+				temps = append(temps, entry)
+				continue
+			}
+			if err := add(entry, file.Name()); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	err = scan(c.cacheDir, func(entry *gcEntry, name string) error {
+		targetPath, err := hex.DecodeString(name)
+		if err != nil {
+			// Not an entry of this cache.
+			return nil
+		}
+		entry.targetPath = string(targetPath)
+		target, ok := readTargetEntry(entry.file)
+		if ok {
+			entry.actionKey = target.ActionKey
+			entry.refs = target.refs()
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = scan(filepath.Join(c.cacheDir, "ac"), func(entry *gcEntry, name string) error {
+		key, ok := parseDigest(name)
+		if !ok {
+			return nil
+		}
+		entry.action = &key
+		entry.refs = c.actionRefs(entry.file)
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = scan(filepath.Join(c.cacheDir, "cas"), func(entry *gcEntry, name string) error {
+		d, _, ok := parseBlobName(name)
+		if !ok {
+			return nil
+		}
+		entry.blob = &d
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = filepath.WalkDir(filepath.Join(c.cacheDir, "quarantine"), func(file string, d fs.DirEntry, err error) error {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil || d.IsDir() {
+			return err
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		temps = append(temps, &gcEntry{file: file, size: info.Size(), used: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read quarantine directory: %w", err)
+	}
+
+	return entries, temps, nil
+}
+
+// readTargetEntry returns the entry of a target stored in file.
+func readTargetEntry(file string) (FileCacheEntry, bool) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return FileCacheEntry{}, false
+	}
+
+	var t FileCacheEntry
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&t); err != nil {
+		return FileCacheEntry{}, false
+	}
+	return t, true
+}
+
+// refs returns the blobs the entry refers to.
+func (t FileCacheEntry) refs() []Digest {
+	if t.IsBlob {
+		return []Digest{t.HashFile}
+	}
+
+	var refs []Digest
+	for _, treeFile := range t.Tree {
+		if treeFile.IsRegular() {
+			refs = append(refs, treeFile.Digest)
+		}
+	}
+	return refs
+}
+
+// actionRefs returns the blobs the action result in file refers to, including the
+// files of its directory outputs.
+func (c *Cache) actionRefs(file string) []Digest {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil
+	}
+
+	result, err := decodeActionResult(data)
+	if err != nil {
+		return nil
+	}
+	return c.resultRefs(result)
+}
+
+// resultRefs returns the blobs the action result refers to, including the files of
+// its directory outputs.
+func (c *Cache) resultRefs(result ActionResult) []Digest {
+	var refs []Digest
+	for _, output := range result.Outputs {
+		refs = append(refs, output.Digest)
+		if !output.IsTree {
+			continue
+		}
+
+		for _, treeFile := range c.readManifest(output.Digest) {
+			if treeFile.IsRegular() {
+				refs = append(refs, treeFile.Digest)
+			}
+		}
+	}
+	return refs
+}
+
+// readManifest returns the files of the tree manifest with digest d if it is stored
+// locally, without recording that it was used.
+func (c *Cache) readManifest(d Digest) []TreeFile {
+	for _, codec := range []Codec{Zstd, Raw} {
+		v, err := openBlobFile(c.blobFile(d, codec), codec, d)
+		if err != nil {
+			continue
+		}
+
+		var files []TreeFile
+		err = gob.NewDecoder(v).Decode(&files)
+		v.Close()
+		if err != nil {
+			return nil
+		}
+		return files
+	}
+	return nil
+}
+
+// touch records that a cache file was used, for the eviction of least recently used
+// entries. Failing to record it only makes the entry look older.
+func touch(file string) {
+	now := time.Now()
+	os.Chtimes(file, now, now)
+}
@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file of the cache directory that is locked to coordinate the
+// builds, and the goroutines of a build, that share the cache. Writing an entry takes
+// a shared lock, so entries are written concurrently; removing entries takes an
+// exclusive lock, so nothing is published while GC decides what is unused and a
+// file is only removed if it was not replaced in the meantime.
+const lockFileName = "lock"
+
+// lock locks the cache and returns a function releasing the lock. Every call opens the
+// lock file on its own, so the lock also coordinates the goroutines of one process.
+func (c *Cache) lock(exclusive bool) (unlock func(), err error) {
+	if err := os.MkdirAll(c.cacheDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create cache directory %s: %w", c.cacheDir, err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(c.cacheDir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cache lock: %w", err)
+	}
+
+	if err := lockFile(file, exclusive); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock cache: %w", err)
+	}
+
+	return func() {
+		unlockFile(file)
+		file.Close()
+	}, nil
+}
+
+// writeFile writes a cache file while holding a shared lock on the cache.
+func (c *Cache) writeFile(file string, data []byte) error {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return writeCacheFile(file, data)
+}
+
+// publish moves the complete temporary file tmp into place as file while holding a
+// shared lock on the cache.
+func (c *Cache) publish(tmp string, file string) error {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	return os.Rename(tmp, file)
+}
+
+// unchangedFunc reports whether file is still the version that was checked.
+type unchangedFunc func(file string) (bool, error)
+
+// sameContent reports whether the file still holds data.
+func sameContent(data []byte) unchangedFunc {
+	return func(file string) (bool, error) {
+		current, err := os.ReadFile(file)
+		if err != nil {
+			return false, err
+		}
+		return bytes.Equal(current, data), nil
+	}
+}
+
+// sameFile reports whether the file is still the one described by info. Every write
+// replaces a cache file with a new one, so this holds as long as it was not written.
+func sameFile(info os.FileInfo) unchangedFunc {
+	return func(file string) (bool, error) {
+		current, err := os.Stat(file)
+		if err != nil {
+			return false, err
+		}
+		return os.SameFile(info, current), nil
+	}
+}
+
+// removeUnchanged removes file, or moves it to dest if dest is set, unless unchanged
+// reports that it was replaced: another build may have replaced a corrupt or
+// incomplete entry with a good one since it was checked. It reports whether the file
+// was removed.
+func (c *Cache) removeUnchanged(file string, unchanged unchangedFunc, dest string) (bool, error) {
+	unlock, err := c.lock(true)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	same, err := unchanged(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		return false, nil
+	}
+
+	if dest == "" {
+		return true, os.Remove(file)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return false, err
+	}
+	return true, os.Rename(file, dest)
+}
@@ -0,0 +1,214 @@
+package cache
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockTestDirEnv makes the test binary run as one of the processes of
+// TestCacheLockProcesses, with the cache directory it names.
+const lockTestDirEnv = "CACHE_LOCK_TEST_DIR"
+
+const (
+	lockTestWorkers = 8
+	lockTestRounds  = 30
+)
+
+// fillOldEntries stores entries of targets that are no longer reachable and backdates
+// them, so GC removes them, and their blobs, while the workers run.
+func fillOldEntries(t *testing.T, c *Cache, n int) {
+	t.Helper()
+	old := time.Now().Add(-2 * DefaultGracePeriod)
+	for i := 0; i < n; i++ {
+		// Some of the content is stored again by the workers.
+		data := []byte(fmt.Sprintf("content %d", i%lockTestRounds))
+		d, _, err := c.PutBlobFrom(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		target := fmt.Sprintf("old/%d", i)
+		if err := c.Set(target, NewBlobTarget(target, d)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := filepath.Walk(c.cacheDir, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		return os.Chtimes(file, old, old)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// useCache stores, records and reads back blobs from several goroutines, while other
+// goroutines collect garbage and verify the cache.
+func useCache(t *testing.T, c *Cache, name string) {
+	t.Helper()
+
+	done := make(chan struct{})
+	errs := make(chan error, 2*lockTestWorkers+2)
+
+	var collectors sync.WaitGroup
+	collectors.Add(2)
+	go func() {
+		defer collectors.Done()
+		options := GCOptions{
+			Reachable: func(targetPath string) bool { return !strings.HasPrefix(targetPath, "old/") },
+		}
+		for {
+			if _, err := c.GC(options); err != nil {
+				errs <- fmt.Errorf("GC: %w", err)
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+	go func() {
+		defer collectors.Done()
+		for {
+			if _, err := c.Verify(true); err != nil {
+				errs <- fmt.Errorf("Verify: %w", err)
+				return
+			}
+			select {
+			case <-done:
+				return
+			default:
+			}
+		}
+	}()
+
+	var workers sync.WaitGroup
+	for w := 0; w < lockTestWorkers; w++ {
+		workers.Add(1)
+		go func(w int) {
+			defer workers.Done()
+			if err := useEntries(c, fmt.Sprintf("%s/%d", name, w)); err != nil {
+				errs <- err
+			}
+		}(w)
+	}
+
+	workers.Wait()
+	close(done)
+	collectors.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+}
+
+// useEntries stores blobs and the entries of targets below prefix, and checks that
+// every entry can be read back with its content.
+func useEntries(c *Cache, prefix string) error {
+	for i := 0; i < lockTestRounds; i++ {
+		data := []byte(fmt.Sprintf("content %d", i))
+		d, _, err := c.PutBlobFrom(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return fmt.Errorf("PutBlobFrom: %w", err)
+		}
+
+		target := fmt.Sprintf("%s/%d", prefix, i)
+		if err := c.Set(target, NewBlobTarget(target, d)); err != nil {
+			return fmt.Errorf("Set %s: %w", target, err)
+		}
+
+		entry, hit, err := c.Get(target)
+		if err != nil {
+			return fmt.Errorf("Get %s: %w", target, err)
+		}
+		if !hit {
+			return fmt.Errorf("Get %s: entry is missing", target)
+		}
+
+		r, _, err := c.Open(entry)
+		if err != nil {
+			return fmt.Errorf("Open %s: %w", target, err)
+		}
+		got, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", target, err)
+		}
+		if !bytes.Equal(got, data) {
+			return fmt.Errorf("read %s: got %q, want %q", target, got, data)
+		}
+	}
+	return nil
+}
+
+// checkVerified verifies the cache and fails if any file is corrupt or incomplete, or
+// if GC has not removed the unreachable entries.
+func checkVerified(t *testing.T, c *Cache) {
+	t.Helper()
+	if _, hit, err := c.Get("old/0"); err != nil || hit {
+		t.Errorf("Get old/0 = %v, %v, want the entry to be removed by GC", hit, err)
+	}
+
+	stats, err := c.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Corrupt != 0 || stats.Incomplete != 0 {
+		t.Errorf("Verify found %d corrupt and %d incomplete files, want none", stats.Corrupt, stats.Incomplete)
+	}
+}
+
+func TestCacheLockGoroutines(t *testing.T) {
+	c := NewCache(t.TempDir())
+	fillOldEntries(t, c, 2*lockTestRounds)
+
+	useCache(t, c, "goroutines")
+	checkVerified(t, c)
+}
+
+func TestCacheLockProcesses(t *testing.T) {
+	if dir := os.Getenv(lockTestDirEnv); dir != "" {
+		useCache(t, NewCache(dir), "process-"+strconv.Itoa(os.Getpid()))
+		return
+	}
+
+	dir := t.TempDir()
+	c := NewCache(dir)
+	fillOldEntries(t, c, 2*lockTestRounds)
+
+	// The test binary is run again as each of the processes sharing the cache.
+	var cmds []*exec.Cmd
+	var outputs []*bytes.Buffer
+	for i := 0; i < 4; i++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^TestCacheLockProcesses$")
+		cmd.Env = append(os.Environ(), lockTestDirEnv+"="+dir)
+		var output bytes.Buffer
+		cmd.Stdout = &output
+		cmd.Stderr = &output
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		cmds = append(cmds, cmd)
+		outputs = append(outputs, &output)
+	}
+
+	for i, cmd := range cmds {
+		if err := cmd.Wait(); err != nil {
+			t.Errorf("process %d failed: %v\n%s", i, err, outputs[i])
+		}
+	}
+
+	checkVerified(t, c)
+}
@@ -0,0 +1,155 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// RemoteCache is a client for a Bazel HTTP cache, such as bazel-remote or the cache
+// server of this tool (see Server): action results live at <url>/ac/<sha256> as
+// ActionResult messages of the remote execution API and blobs at <url>/cas/<sha256>,
+// and both are read with GET and written with PUT. Like Bazel, it uploads blobs as
+// they are.
+type RemoteCache struct {
+	baseURL string
+	client  *http.Client
+
+	// compress accepts blobs compressed with zstd, using the Accept-Encoding header.
+	// Not every cache server understands it.
+	compress bool
+}
+
+func NewRemoteCache(baseURL string) *RemoteCache {
+	return &RemoteCache{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  http.DefaultClient,
+	}
+}
+
+// SetCompression selects whether blobs are downloaded compressed.
+func (r *RemoteCache) SetCompression(enabled bool) {
+	r.compress = enabled
+}
+
+func (r *RemoteCache) url(kind string, d Digest) string {
+	return r.baseURL + "/" + kind + "/" + d.String()
+}
+
+// get downloads the action result or blob stored under d. A missing entry is not an error.
+func (r *RemoteCache) get(kind string, d Digest) ([]byte, bool, error) {
+	body, _, hit, err := r.open(kind, d)
+	if err != nil || !hit {
+		return nil, hit, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read %s/%s from remote cache: %w", kind, d, err)
+	}
+	return data, true, nil
+}
+
+// has reports whether the remote cache holds the action result or blob stored under d.
+func (r *RemoteCache) has(kind string, d Digest) (bool, error) {
+	resp, err := r.client.Head(r.url(kind, d))
+	if err != nil {
+		return false, fmt.Errorf("failed to check %s/%s in remote cache: %w", kind, d, err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("failed to check %s/%s in remote cache: %s", kind, d, resp.Status)
+	}
+}
+
+// open starts downloading the action result or blob stored under d and returns its
+// decompressed content as a stream, with the size of the content if the server sent it,
+// or -1. A missing entry is not an error.
+func (r *RemoteCache) open(kind string, d Digest) (io.ReadCloser, int64, bool, error) {
+	req, err := http.NewRequest(http.MethodGet, r.url(kind, d), nil)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	if r.compress {
+		req.Header.Set("Accept-Encoding", "zstd")
+	}
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, 0, false, fmt.Errorf("failed to get %s/%s from remote cache: %w", kind, d, err)
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, 0, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, 0, false, fmt.Errorf("failed to get %s/%s from remote cache: %s", kind, d, resp.Status)
+	}
+
+	if resp.Header.Get("Content-Encoding") != "zstd" {
+		return resp.Body, resp.ContentLength, true, nil
+	}
+
+	// The Content-Length is the compressed size; the content size is in the frame header.
+	br := bufio.NewReader(resp.Body)
+	size := peekContentSize(br)
+	dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, false, fmt.Errorf("failed to read %s/%s from remote cache: %w", kind, d, err)
+	}
+	return &zstdBody{dec, resp.Body}, size, true, nil
+}
+
+// zstdBody decompresses a response body.
+type zstdBody struct {
+	*zstd.Decoder
+	body io.Closer
+}
+
+func (b *zstdBody) Close() error {
+	b.Decoder.Close()
+	return b.body.Close()
+}
+
+// put uploads an action result or blob under d.
+func (r *RemoteCache) put(kind string, d Digest, data []byte) error {
+	return r.putStream(kind, d, bytes.NewReader(data), int64(len(data)))
+}
+
+// putStream uploads the content read from body under d without holding it in memory.
+// size is the length of the content. The content is sent uncompressed, because Bazel
+// cache servers expect the blob under its digest as it is.
+func (r *RemoteCache) putStream(kind string, d Digest, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, r.url(kind, d), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to put %s/%s into remote cache: %w", kind, d, err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("failed to put %s/%s into remote cache: %s", kind, d, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,166 @@
+package cache
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Server serves a cache directory over the HTTP protocol used by RemoteCache.
+// It uses the same layout as the ac and cas directories of a local Cache.
+type Server struct {
+	dir string
+
+	// codec compresses the blobs stored by the server.
+	codec Codec
+}
+
+func NewServer(dir string) (*Server, error) {
+	for _, kind := range []string{"ac", "cas"} {
+		if err := os.MkdirAll(filepath.Join(dir, kind), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create cache directory %s: %w", dir, err)
+		}
+	}
+	return &Server{dir: dir, codec: Zstd}, nil
+}
+
+// SetCompression selects whether the server stores new blobs compressed. Clients that
+// do not accept zstd get every blob uncompressed either way.
+func (s *Server) SetCompression(enabled bool) {
+	s.codec = Raw
+	if enabled {
+		s.codec = Zstd
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	kind, name, ok := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if !ok || (kind != "ac" && kind != "cas") || !isDigest(name) {
+		http.NotFound(w, r)
+		return
+	}
+	file := filepath.Join(s.dir, kind, name)
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if kind == "cas" {
+			s.getBlob(w, r, name)
+			return
+		}
+		http.ServeFile(w, r, file)
+
+	case http.MethodPut:
+		if err := s.put(kind, name, r.Header.Get("Content-Encoding"), r.Body, r.ContentLength); err != nil {
+			fmt.Printf("Failed to store %s/%s: %v\n", kind, name, err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+	default:
+		w.Header().Set("Allow", "GET, HEAD, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getBlob serves the blob name. A compressed blob is sent as it is stored to clients
+// accepting zstd, and decompressed while it is sent to the others.
+func (s *Server) getBlob(w http.ResponseWriter, r *http.Request, name string) {
+	compressed := filepath.Join(s.dir, "cas", name+blobExt[Zstd])
+	file, err := os.Open(compressed)
+	if os.IsNotExist(err) {
+		http.ServeFile(w, r, filepath.Join(s.dir, "cas", name))
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer file.Close()
+
+	if strings.Contains(r.Header.Get("Accept-Encoding"), "zstd") {
+		w.Header().Set("Content-Encoding", "zstd")
+		http.ServeFile(w, r, compressed)
+		return
+	}
+
+	dec, err := zstd.NewReader(file, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer dec.Close()
+
+	if size, ok := zstdContentSize(compressed); ok {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodGet {
+		if _, err := io.Copy(w, dec); err != nil {
+			fmt.Printf("Failed to send cas/%s: %v\n", name, err)
+		}
+	}
+}
+
+// put streams body to a temporary file and moves it into place once it is complete,
+// so a concurrent GET never sees a partial entry. size is the length of body, or -1.
+func (s *Server) put(kind string, name string, encoding string, body io.Reader, size int64) error {
+	switch encoding {
+	case "":
+	case "zstd":
+		br := bufio.NewReader(body)
+		size = peekContentSize(br)
+		dec, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		defer dec.Close()
+		body = dec
+	default:
+		return fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	dir := filepath.Join(s.dir, kind)
+	tmp, err := os.CreateTemp(dir, name+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	codec := Raw
+	if kind == "cas" {
+		codec = s.codec
+	}
+
+	h := sha256.New()
+	codec, n, err := encodeStream(codec, tmp, io.TeeReader(body, h), size)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		codec, err = keepSmaller(tmp.Name(), codec, n)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Blobs are addressed by their content, so a blob that does not match its name is rejected.
+	if kind == "cas" && hex.EncodeToString(h.Sum(nil)) != name {
+		return fmt.Errorf("content does not match digest %s", name)
+	}
+
+	return os.Rename(tmp.Name(), filepath.Join(dir, name+blobExt[codec]))
+}
+
+func isDigest(name string) bool {
+	b, err := hex.DecodeString(name)
+	return err == nil && len(b) == len(Digest{})
+}
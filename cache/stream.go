@@ -0,0 +1,539 @@
+package cache
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// NewBlobTarget returns the entry of the target at path whose content is the blob with
+// digest d.
+func NewBlobTarget(path string, d Digest) FileCacheEntry {
+	return FileCacheEntry{
+		TargetPath: path,
+		HashFile:   d,
+		IsBlob:     true,
+	}
+}
+
+// PutFile stores the file at filePath as the content of the target at path. The file
+// is streamed into the cache, so it never has to fit in memory.
+func (c *Cache) PutFile(path string, filePath string) (FileCacheEntry, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return FileCacheEntry{}, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return FileCacheEntry{}, err
+	}
+	return c.PutReader(path, file, info.Size())
+}
+
+// PutReader stores the content read from r as the content of the target at path. size
+// is the length of the content if it is known, or -1.
+func (c *Cache) PutReader(path string, r io.Reader, size int64) (FileCacheEntry, error) {
+	d, _, err := c.PutBlobFrom(r, size)
+	if err != nil {
+		return FileCacheEntry{}, fmt.Errorf("failed to store %s: %w", path, err)
+	}
+	return NewBlobTarget(path, d), nil
+}
+
+// Open returns the content of a file entry and its size. The content is verified while
+// it is read, and the reader fails at the end if it does not match the entry.
+func (c *Cache) Open(entry FileCacheEntry) (io.ReadCloser, int64, error) {
+	if !entry.IsBlob {
+		return io.NopCloser(bytes.NewReader(entry.File)), int64(len(entry.File)), nil
+	}
+
+	size, hit, err := c.BlobSize(entry.HashFile)
+	if err == nil && hit {
+		var r io.ReadCloser
+		r, hit, err = c.OpenBlob(entry.HashFile)
+		if err == nil && hit {
+			return r, size, nil
+		}
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return nil, 0, fmt.Errorf("content of %s is missing from the cache", entry.TargetPath)
+}
+
+// ReadFile returns the content of a file entry. It is meant for small files like
+// depfiles; large files are better read with Open.
+func (c *Cache) ReadFile(entry FileCacheEntry) ([]byte, error) {
+	r, _, err := c.Open(entry)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s from the cache: %w", entry.TargetPath, err)
+	}
+	return data, nil
+}
+
+// WriteEntry writes the file or directory of an entry to dest.
+func (c *Cache) WriteEntry(entry FileCacheEntry, dest string) error {
+	if entry.IsTree {
+		return c.WriteTree(entry, dest)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", dest, err)
+	}
+
+	r, _, err := c.Open(entry)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := writeFileFrom(dest, r, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	return nil
+}
+
+// PutBlobFrom stores the content read from r as a blob and returns its digest and
+// size. The content is streamed to disk while it is hashed. size is the length of the
+// content if it is known, or -1.
+func (c *Cache) PutBlobFrom(r io.Reader, size int64) (Digest, int64, error) {
+	d, n, err := c.storeBlob(r, size)
+	if err != nil {
+		return Digest{}, 0, err
+	}
+	c.uploadBlob(d, n)
+	return d, n, nil
+}
+
+// storeBlob stores the content read from r as a local blob.
+func (c *Cache) storeBlob(r io.Reader, size int64) (Digest, int64, error) {
+	dir := filepath.Join(c.cacheDir, "cas")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Digest{}, 0, fmt.Errorf("failed to create cache directory: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "blob.tmp-*")
+	if err != nil {
+		return Digest{}, 0, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	codec, n, err := encodeStream(c.codec, tmp, io.TeeReader(r, h), size)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		codec, err = keepSmaller(tmp.Name(), codec, n)
+	}
+	if err == nil {
+		err = os.Chmod(tmp.Name(), 0644)
+	}
+	if err != nil {
+		return Digest{}, 0, fmt.Errorf("failed to write blob: %w", err)
+	}
+
+	var d Digest
+	copy(d[:], h.Sum(nil))
+
+	// An existing copy is replaced, which also repairs a corrupt one.
+	if err := c.publish(tmp.Name(), c.blobFile(d, codec)); err != nil {
+		return Digest{}, 0, fmt.Errorf("failed to write blob %s: %w", d, err)
+	}
+	return d, n, nil
+}
+
+// encodeStream copies r to w, compressed with codec, and returns the codec used and the
+// number of bytes read from r. size is the length of the content if it is known, or -1.
+// Unlike encode, it cannot tell whether compressing pays off before the content has been
+// written, so the caller checks that with keepSmaller.
+func encodeStream(codec Codec, w io.Writer, r io.Reader, size int64) (Codec, int64, error) {
+	if codec != Zstd {
+		n, err := io.Copy(w, r)
+		return Raw, n, err
+	}
+
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return Raw, 0, err
+	}
+	// The content size in the frame header lets BlobSize skip decompressing.
+	enc.ResetContentSize(w, size)
+
+	n, err := io.Copy(enc, r)
+	if err != nil {
+		enc.Close()
+		return Raw, 0, err
+	}
+	return Zstd, n, enc.Close()
+}
+
+// keepSmaller stores the compressed file raw again if compressing did not make its n
+// bytes of content smaller, like encode does, and returns the codec file is stored with.
+func keepSmaller(file string, codec Codec, n int64) (Codec, error) {
+	if codec != Zstd {
+		return codec, nil
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return codec, err
+	}
+	if info.Size() < n {
+		return Zstd, nil
+	}
+
+	src, err := os.Open(file)
+	if err != nil {
+		return codec, err
+	}
+	defer src.Close()
+
+	dec, err := zstd.NewReader(src, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return codec, err
+	}
+	defer dec.Close()
+
+	raw, err := os.CreateTemp(filepath.Dir(file), "blob.tmp-*")
+	if err != nil {
+		return codec, err
+	}
+	defer os.Remove(raw.Name())
+
+	if _, err := io.Copy(raw, dec); err != nil {
+		raw.Close()
+		return codec, err
+	}
+	if err := raw.Close(); err != nil {
+		return codec, err
+	}
+	if err := os.Rename(raw.Name(), file); err != nil {
+		return codec, err
+	}
+	return Raw, nil
+}
+
+// OpenBlob opens the blob with digest d for reading, downloading it from the remote
+// cache if it is only stored there. The content is verified while it is read: the
+// reader fails at the end if it does not match d, and the blob is quarantined.
+func (c *Cache) OpenBlob(d Digest) (io.ReadCloser, bool, error) {
+	r, hit, err := c.openLocalBlob(d)
+	if err != nil || hit {
+		return r, hit, err
+	}
+
+	hit, err = c.fetchBlob(d)
+	if err != nil || !hit {
+		return nil, false, err
+	}
+	return c.openLocalBlob(d)
+}
+
+// openLocalBlob opens the local blob with digest d like OpenBlob, without downloading it.
+func (c *Cache) openLocalBlob(d Digest) (io.ReadCloser, bool, error) {
+	for _, codec := range []Codec{Zstd, Raw} {
+		file := c.blobFile(d, codec)
+		v, err := openBlobFile(file, codec, d)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+
+		info := v.info
+		v.corrupt = func(reason error) {
+			c.quarantineIf(file, sameFile(info), reason)
+		}
+		touch(file)
+		return v, true, nil
+	}
+	return nil, false, nil
+}
+
+// openBlobFile opens the blob with digest d stored in file with codec, and verifies its
+// content while it is read. The reader does not quarantine a corrupt blob by itself.
+func openBlobFile(file string, codec Codec, d Digest) (*verifyingReader, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob %s: %w", d, err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to open blob %s: %w", d, err)
+	}
+
+	v := &verifyingReader{
+		r:       f,
+		h:       sha256.New(),
+		want:    d,
+		info:    info,
+		closers: []func() error{f.Close},
+	}
+	if codec == Zstd {
+		dec, err := zstd.NewReader(f, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to open blob %s: %w", d, err)
+		}
+		v.r = dec
+		v.decompressing = true
+		v.closers = []func() error{func() error { dec.Close(); return nil }, f.Close}
+	}
+	return v, nil
+}
+
+// BlobSize returns the size of the content of the blob with digest d.
+func (c *Cache) BlobSize(d Digest) (int64, bool, error) {
+	if _, found := c.findBlob(d); !found {
+		if hit, err := c.fetchBlob(d); err != nil || !hit {
+			return 0, false, err
+		}
+	}
+
+	if info, err := os.Stat(c.blobFile(d, Raw)); err == nil {
+		return info.Size(), true, nil
+	}
+
+	if size, ok := zstdContentSize(c.blobFile(d, Zstd)); ok {
+		return size, true, nil
+	}
+
+	r, hit, err := c.openLocalBlob(d)
+	if err != nil || !hit {
+		return 0, hit, err
+	}
+	defer r.Close()
+
+	size, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read blob %s: %w", d, err)
+	}
+	return size, true, nil
+}
+
+// zstdContentSize returns the size of the content of a compressed file as recorded in
+// its frame header. It is not recorded if the content was streamed in without knowing it.
+func zstdContentSize(file string) (int64, bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, false
+	}
+	defer f.Close()
+
+	header := make([]byte, zstd.HeaderMaxSize)
+	n, _ := io.ReadFull(f, header)
+	return frameContentSize(header[:n])
+}
+
+// peekContentSize returns the content size recorded in the frame header of a compressed
+// stream without consuming it, or -1 if it is not recorded.
+func peekContentSize(br *bufio.Reader) int64 {
+	header, _ := br.Peek(zstd.HeaderMaxSize)
+	if size, ok := frameContentSize(header); ok {
+		return size
+	}
+	return -1
+}
+
+func frameContentSize(header []byte) (int64, bool) {
+	var h zstd.Header
+	if err := h.Decode(header); err != nil || !h.HasFCS {
+		return 0, false
+	}
+	return int64(h.FrameContentSize), true
+}
+
+// fetchBlob downloads the blob with digest d from the remote cache into the local cache.
+// An unreachable remote cache is treated as a miss.
+func (c *Cache) fetchBlob(d Digest) (bool, error) {
+	if c.remote == nil {
+		return false, nil
+	}
+
+	body, size, hit, err := c.remote.open("cas", d)
+	if err != nil {
+		fmt.Printf("Warning: %v\n", err)
+		return false, nil
+	}
+	if !hit {
+		return false, nil
+	}
+	defer body.Close()
+
+	// The size is recorded with the blob, so BlobSize does not have to decompress it.
+	got, _, err := c.storeBlob(body, size)
+	if err != nil {
+		return false, err
+	}
+	if got != d {
+		return false, fmt.Errorf("blob %s from remote cache does not match its digest", d)
+	}
+	return true, nil
+}
+
+// uploadBlob streams the local blob with digest d and size to the remote cache. A
+// failed upload only costs other builds a cache hit, so it is reported but does not
+// fail the build.
+func (c *Cache) uploadBlob(d Digest, size int64) {
+	if c.remote == nil {
+		return
+	}
+
+	r, hit, err := c.openLocalBlob(d)
+	if err != nil || !hit {
+		fmt.Printf("Warning: failed to upload blob %s: %v\n", d, err)
+		return
+	}
+	defer r.Close()
+
+	if err := c.remote.putStream("cas", d, r, size); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// writeBlobTo writes the content of the blob with digest d to dest with mode. name is
+// the name of the file in errors.
+func (c *Cache) writeBlobTo(d Digest, dest string, mode os.FileMode, name string) error {
+	r, hit, err := c.OpenBlob(d)
+	if err != nil {
+		return err
+	}
+	if !hit {
+		return fmt.Errorf("content of %s is missing from the cache", name)
+	}
+	defer r.Close()
+
+	if err := writeFileFrom(dest, r, mode); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dest, err)
+	}
+	return nil
+}
+
+// FileDigest returns the content digest of the file at path, reading it in chunks.
+func FileDigest(path string) (Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return Digest{}, err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return Digest{}, err
+	}
+
+	var d Digest
+	copy(d[:], h.Sum(nil))
+	return d, nil
+}
+
+// writeFileFrom writes the content read from r to the file dest with mode. The content
+// is written to a temporary file next to dest, which replaces dest only once r has been
+// read to the end without error, so content that fails verification never reaches dest.
+func writeFileFrom(dest string, r io.Reader, mode os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(dest), filepath.Base(dest)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), mode); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dest)
+}
+
+// verifyingReader hashes the content while it is read and fails at the end of it if
+// the content does not match the digest it is stored under.
+type verifyingReader struct {
+	r       io.Reader
+	h       hash.Hash
+	want    Digest
+	info    os.FileInfo
+	closers []func() error
+	checked bool
+
+	// decompressing is set if r decompresses the file, so its errors mean the file
+	// is corrupt.
+	decompressing bool
+
+	// corrupt is called once if the content turns out to be corrupt.
+	corrupt func(reason error)
+}
+
+// corruptError reports that a blob does not hold the content it is stored under.
+type corruptError struct {
+	err error
+}
+
+func (e *corruptError) Error() string { return e.err.Error() }
+func (e *corruptError) Unwrap() error { return e.err }
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	if v.checked {
+		return 0, io.EOF
+	}
+
+	n, err := v.r.Read(p)
+	v.h.Write(p[:n])
+
+	if err != nil && err != io.EOF && v.decompressing {
+		return n, v.fail(fmt.Errorf("failed to decompress: %w", err))
+	}
+	if err == io.EOF {
+		v.checked = true
+		var got Digest
+		copy(got[:], v.h.Sum(nil))
+		if got != v.want {
+			return n, v.fail(fmt.Errorf("content does not match digest %s", v.want))
+		}
+	}
+	return n, err
+}
+
+// fail reports that the content is corrupt.
+func (v *verifyingReader) fail(reason error) error {
+	v.checked = true
+	if v.corrupt != nil {
+		v.corrupt(reason)
+	}
+	return &corruptError{reason}
+}
+
+func (v *verifyingReader) Close() error {
+	var err error
+	for _, closeFn := range v.closers {
+		if closeErr := closeFn(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,232 @@
+package cache
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// TreeFile is a single file of a directory (tree) artifact.
+// The content of a regular file is stored as a blob in the content-addressed store.
+// Symbolic links and empty directories are recorded by their mode and have no content.
+type TreeFile struct {
+	// Path is the slash separated path of the file relative to the directory.
+	Path   string
+	Mode   fs.FileMode
+	Digest Digest
+
+	// Link is the target of a symbolic link.
+	Link string
+}
+
+// IsRegular reports whether the entry is a regular file with content in a blob.
+func (f TreeFile) IsRegular() bool {
+	return f.Mode.IsRegular()
+}
+
+// IsSymlink reports whether the entry is a symbolic link.
+func (f TreeFile) IsSymlink() bool {
+	return f.Mode&fs.ModeSymlink != 0
+}
+
+// IsDir reports whether the entry is an empty directory.
+func (f TreeFile) IsDir() bool {
+	return f.Mode.IsDir()
+}
+
+// NewTree returns a cache entry for the directory at path that contains files.
+// Directories in files that are not empty are dropped, as restoring their contents
+// creates them anyway.
+func NewTree(path string, files []TreeFile) FileCacheEntry {
+	sorted := make([]TreeFile, 0, len(files))
+	for _, file := range files {
+		if !file.IsDir() || isEmptyDir(file.Path, files) {
+			sorted = append(sorted, file)
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Path < sorted[j].Path })
+
+	manifest := encodeTreeManifest(sorted)
+	entry := NewTarget(path, nil)
+	entry.HashFile = DigestOf(manifest)
+	entry.IsTree = true
+	entry.Tree = sorted
+	return entry
+}
+
+// isEmptyDir reports whether no other entry of files lies below dir.
+func isEmptyDir(dir string, files []TreeFile) bool {
+	for _, file := range files {
+		if strings.HasPrefix(file.Path, dir+"/") {
+			return false
+		}
+	}
+	return true
+}
+
+// encodeTreeManifest returns the canonical encoding of the (sorted) files of a tree.
+// The digest of the encoding identifies the content of the whole tree.
+func encodeTreeManifest(files []TreeFile) []byte {
+	var buf bytes.Buffer
+	for _, file := range files {
+		switch {
+		case file.IsSymlink():
+			fmt.Fprintf(&buf, "%s\x00link\x00%s\n", file.Path, file.Link)
+		case file.IsDir():
+			fmt.Fprintf(&buf, "%s\x00dir\n", file.Path)
+		default:
+			fmt.Fprintf(&buf, "%s\x00%o\x00%s\n", file.Path, uint32(file.Mode.Perm()), file.Digest)
+		}
+	}
+	return buf.Bytes()
+}
+
+// PutTreeManifest stores the file list of a tree as a blob, so an action result
+// can refer to the whole tree by a single digest.
+func (c *Cache) PutTreeManifest(files []TreeFile) (Digest, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(files); err != nil {
+		return Digest{}, fmt.Errorf("failed to encode tree manifest: %w", err)
+	}
+	return c.PutBlob(buf.Bytes())
+}
+
+// GetTreeManifest returns the file list stored with PutTreeManifest.
+func (c *Cache) GetTreeManifest(d Digest) ([]TreeFile, bool, error) {
+	data, hit, err := c.GetBlob(d)
+	if err != nil || !hit {
+		return nil, hit, err
+	}
+
+	var files []TreeFile
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&files); err != nil {
+		return nil, false, fmt.Errorf("failed to decode tree manifest %s: %w", d, err)
+	}
+	return files, true, nil
+}
+
+// PutDirectory stores every regular file below dir as a blob and returns
+// a tree entry for targetPath describing the directory.
+func (c *Cache) PutDirectory(targetPath string, dir string) (FileCacheEntry, error) {
+	files, err := scanDirectory(dir, func(file string, size int64) (Digest, error) {
+		f, err := os.Open(file)
+		if err != nil {
+			return Digest{}, err
+		}
+		defer f.Close()
+
+		d, _, err := c.PutBlobFrom(f, size)
+		return d, err
+	})
+	if err != nil {
+		return FileCacheEntry{}, err
+	}
+	return NewTree(targetPath, files), nil
+}
+
+// DirectoryDigest returns the content digest the directory would have as a tree entry,
+// without storing anything in the cache.
+func DirectoryDigest(dir string) (Digest, error) {
+	files, err := scanDirectory(dir, func(file string, size int64) (Digest, error) {
+		return FileDigest(file)
+	})
+	if err != nil {
+		return Digest{}, err
+	}
+	return NewTree(dir, files).ContentDigest(), nil
+}
+
+// scanDirectory lists the regular files, symbolic links and directories below dir, with
+// the digest store returns for each regular file. Links are recorded, not followed.
+func scanDirectory(dir string, store func(file string, size int64) (Digest, error)) ([]TreeFile, error) {
+	var files []TreeFile
+
+	err := filepath.WalkDir(dir, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if filePath == dir {
+			if !d.IsDir() {
+				return fmt.Errorf("%s is not a directory", dir)
+			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+		file := TreeFile{Path: filepath.ToSlash(rel)}
+
+		switch {
+		case d.IsDir():
+			file.Mode = fs.ModeDir | 0755
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			file.Mode = fs.ModeSymlink | 0777
+			file.Link = filepath.ToSlash(link)
+		case d.Type().IsRegular():
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			file.Mode = info.Mode().Perm()
+			file.Digest, err = store(filePath, info.Size())
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s is not a regular file, symbolic link or directory", filePath)
+		}
+
+		files = append(files, file)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory %s: %w", dir, err)
+	}
+
+	return files, nil
+}
+
+// WriteTree restores the files of a tree entry below dir.
+func (c *Cache) WriteTree(entry FileCacheEntry, dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+
+	for _, file := range entry.Tree {
+		filePath := filepath.Join(dir, filepath.FromSlash(file.Path))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return fmt.Errorf("failed to create directory for %s: %w", filePath, err)
+		}
+
+		if file.IsDir() {
+			if err := os.MkdirAll(filePath, file.Mode.Perm()); err != nil {
+				return fmt.Errorf("failed to create directory %s: %w", filePath, err)
+			}
+			continue
+		}
+		if file.IsSymlink() {
+			os.Remove(filePath)
+			if err := os.Symlink(filepath.FromSlash(file.Link), filePath); err != nil {
+				return fmt.Errorf("failed to create symbolic link %s: %w", filePath, err)
+			}
+			continue
+		}
+
+		if err := c.writeBlobTo(file.Digest, filePath, file.Mode, path.Join(entry.TargetPath, file.Path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package cache
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyStats reports the outcome of Verify.
+type VerifyStats struct {
+	Checked int
+
+	// Corrupt counts the files that cannot be decoded or do not match their hash.
+	Corrupt int
+
+	// Incomplete counts the entries that refer to blobs missing from the cache.
+	Incomplete int
+
+	// Restored counts the corrupt blobs downloaded again from the remote cache.
+	Restored int
+}
+
+// Verify checks every file of the cache: blobs against their digests, action results
+// and entries of targets against their hashes and for missing blobs. With repair,
+// corrupt files are quarantined, corrupt blobs are downloaded again from the remote
+// cache and incomplete entries are removed, so that every remaining entry can be
+// restored. Without it the problems are only reported.
+func (c *Cache) Verify(repair bool) (VerifyStats, error) {
+	var stats VerifyStats
+
+	corrupt := func(file string, unchanged unchangedFunc, reason error) {
+		stats.Corrupt++
+		if repair {
+			c.quarantineIf(file, unchanged, reason)
+		} else {
+			fmt.Printf("Cache file %s is corrupt: %v\n", file, reason)
+		}
+	}
+
+	missingBlob := func(file string, data []byte, refs []Digest) error {
+		for _, d := range refs {
+			if _, found := c.findBlob(d); found {
+				continue
+			}
+			missing, err := c.stillMissing(file, data, d)
+			if err != nil {
+				return err
+			}
+			if !missing {
+				continue
+			}
+
+			stats.Incomplete++
+			fmt.Printf("Cache file %s refers to missing blob %s\n", file, d)
+			if repair {
+				if _, err := c.removeUnchanged(file, sameContent(data), ""); err != nil {
+					return fmt.Errorf("failed to remove %s: %w", file, err)
+				}
+			}
+			return nil
+		}
+		return nil
+	}
+
+	// Blobs are checked first, so the entries referring to a corrupt blob that could
+	// not be restored are known to be incomplete.
+	blobDir := filepath.Join(c.cacheDir, "cas")
+	names, err := cacheFiles(blobDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		d, codec, ok := parseBlobName(name)
+		if !ok {
+			continue
+		}
+
+		// The blob is streamed through the check, so it never has to fit in memory.
+		file := filepath.Join(blobDir, name)
+		v, err := openBlobFile(file, codec, d)
+		if os.IsNotExist(err) {
+			// Removed by GC since the directory was read.
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		stats.Checked++
+		_, err = io.Copy(io.Discard, v)
+		v.Close()
+
+		var bad *corruptError
+		if !errors.As(err, &bad) {
+			if err != nil {
+				return stats, fmt.Errorf("failed to read blob %s: %w", d, err)
+			}
+			continue
+		}
+
+		corrupt(file, sameFile(v.info), err)
+		if repair {
+			if hit, err := c.fetchBlob(d); err == nil && hit {
+				stats.Restored++
+			}
+		}
+	}
+
+	actionDir := filepath.Join(c.cacheDir, "ac")
+	names, err = cacheFiles(actionDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		file := filepath.Join(actionDir, name)
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read action cache file %s: %w", file, err)
+		}
+		stats.Checked++
+
+		result, err := decodeActionResult(data)
+		if err != nil {
+			corrupt(file, sameContent(data), err)
+			continue
+		}
+		if err := missingBlob(file, data, c.resultRefs(result)); err != nil {
+			return stats, err
+		}
+	}
+
+	names, err = cacheFiles(c.cacheDir)
+	if err != nil {
+		return stats, err
+	}
+	for _, name := range names {
+		targetPath, err := hex.DecodeString(name)
+		if err != nil {
+			// Not an entry of this cache.
+			continue
+		}
+
+		file := filepath.Join(c.cacheDir, name)
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return stats, fmt.Errorf("failed to read cache file %s: %w", file, err)
+		}
+		stats.Checked++
+
+		t, err := decodeEntry(data, string(targetPath))
+		if err != nil {
+			corrupt(file, sameContent(data), err)
+			continue
+		}
+		if err := missingBlob(file, data, t.refs()); err != nil {
+			return stats, err
+		}
+	}
+
+	return stats, nil
+}
+
+// stillMissing reports whether file, read as data, still refers to the missing blob d.
+// GC removes an entry before the blobs it refers to, so the entry may have been removed
+// or replaced after it was read; the shared lock keeps GC from running while this is
+// checked.
+func (c *Cache) stillMissing(file string, data []byte, d Digest) (bool, error) {
+	unlock, err := c.lock(false)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	same, err := sameContent(data)(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !same {
+		return false, nil
+	}
+	_, found := c.findBlob(d)
+	return !found, nil
+}
+
+// cacheFiles returns the names of the files in dir, without the temporary files of
+// unfinished writes. A missing directory has no files.
+func cacheFiles(dir string) ([]string, error) {
+	files, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory %s: %w", dir, err)
+	}
+
+	var names []string
+	for _, file := range files {
+		if file.IsDir() || strings.Contains(file.Name(), ".tmp-") {
+			continue
+		}
+		names = append(names, file.Name())
+	}
+	return names, nil
+}
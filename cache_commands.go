@@ -0,0 +1,239 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// runCache manages the cache directory:
+//
+//	cache clear    removes the cache
+//	cache gc       removes unused entries from the cache
+//	cache verify   checks the cache for corrupt entries and repairs it
+//	cache server   serves the cache to other builds using -remote-cache
+func runCache(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: BSc-build-systems cache clear | gc | verify | server [flags]")
+		return exitUsage
+	}
+
+	switch args[0] {
+	case "clear":
+		return runCacheClear(args[1:])
+	case "gc":
+		return runCacheGC(args[1:])
+	case "verify":
+		return runCacheVerify(args[1:])
+	case "server":
+		return runCacheServer(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown cache command %q\n", args[0])
+	return exitUsage
+}
+
+// runCacheClear removes the cache directory of the project.
+func runCacheClear(args []string) int {
+	flags := flag.NewFlagSet("cache clear", flag.ExitOnError)
+	o := addOptions(flags)
+	flags.Parse(args)
+
+	p, err := loadProject(o, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	if err := clearCache(p.cacheDir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runCacheServer serves a cache directory to other builds using the -remote-cache flag.
+func runCacheServer(args []string) int {
+	flags := flag.NewFlagSet("cache server", flag.ExitOnError)
+	addr := flags.String("addr", ":8080", "address to listen on")
+	dir := flags.String("dir", "./remote-cache", "directory to store the cache in")
+	compress := flags.Bool("compress", true, "store new blobs compressed with zstd")
+	flags.Parse(args)
+
+	server, err := cache.NewServer(*dir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating cache server: %v\n", err)
+		return exitFailure
+	}
+	server.SetCompression(*compress)
+
+	fmt.Printf("Serving cache %s on %s\n", *dir, *addr)
+	if err := http.ListenAndServe(*addr, server); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving cache: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runCacheGC removes the entries of targets that are no longer part of the build graph,
+// and evicts the least recently used entries beyond the size and age limits.
+func runCacheGC(args []string) int {
+	flags := flag.NewFlagSet("cache gc", flag.ExitOnError)
+	o := addOptions(flags)
+	limits := addCacheLimits(flags, "")
+	grace := flags.Duration("grace", cache.DefaultGracePeriod, "keep the entries used more recently, e.g. by a running build")
+	keepUnreachable := flags.Bool("keep-unreachable", false, "keep the entries of targets that are not part of the build graph")
+	dryRun := flags.Bool("dry-run", false, "only report what would be removed")
+	flags.Parse(args)
+
+	options, err := limits.options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	options.GracePeriod = *grace
+	options.DryRun = *dryRun
+
+	p, err := loadProject(o, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	if !*keepUnreachable {
+		options.Reachable = func(targetPath string) bool {
+			_, exists := p.builder.Nodes[targetPath]
+			return exists
+		}
+	}
+
+	stats, err := cache.NewCache(p.cacheDir).GC(options)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error collecting garbage: %v\n", err)
+		return exitFailure
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d cache files (%s), kept %d (%s)\n", verb, stats.Removed, formatSize(stats.RemovedBytes), stats.Kept, formatSize(stats.KeptBytes))
+	return exitOK
+}
+
+// runCacheVerify checks every file of the cache against its hash. Corrupt files are
+// quarantined and entries missing blobs are removed, unless -dry-run is given.
+func runCacheVerify(args []string) int {
+	flags := flag.NewFlagSet("cache verify", flag.ExitOnError)
+	o := addOptions(flags)
+	dryRun := flags.Bool("dry-run", false, "only report the problems, do not repair them")
+	flags.Parse(args)
+
+	p, err := loadProject(o, nil)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	stats, err := openCache(o, p.cacheDir).Verify(!*dryRun)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error verifying cache: %v\n", err)
+		return exitFailure
+	}
+
+	fmt.Printf("Checked %d cache files: %d corrupt, %d incomplete\n", stats.Checked, stats.Corrupt, stats.Incomplete)
+	if stats.Restored > 0 {
+		fmt.Printf("Downloaded %d corrupt blobs again from the remote cache\n", stats.Restored)
+	}
+	if *dryRun && stats.Corrupt+stats.Incomplete > 0 {
+		return exitFailure
+	}
+	return exitOK
+}
+
+// cacheLimits are the flags bounding the size and age of the cache.
+type cacheLimits struct {
+	maxSize string
+	maxAge  string
+}
+
+// addCacheLimits registers the flags -<prefix>max-size and -<prefix>max-age.
+func addCacheLimits(flags *flag.FlagSet, prefix string) *cacheLimits {
+	l := &cacheLimits{}
+	flags.StringVar(&l.maxSize, prefix+"max-size", "", "evict the least recently used cache entries beyond this size, e.g. 500M or 10G")
+	flags.StringVar(&l.maxAge, prefix+"max-age", "", "evict the cache entries not used for this long, e.g. 72h or 30d")
+	return l
+}
+
+// options returns the GC options enforcing the limits.
+func (l *cacheLimits) options() (cache.GCOptions, error) {
+	var options cache.GCOptions
+	var err error
+
+	if l.maxSize != "" {
+		if options.MaxSize, err = parseSize(l.maxSize); err != nil {
+			return options, err
+		}
+	}
+	if l.maxAge != "" {
+		if options.MaxAge, err = parseAge(l.maxAge); err != nil {
+			return options, err
+		}
+	}
+	return options, nil
+}
+
+// parseSize parses a number of bytes with an optional K, M, G or T suffix.
+func parseSize(s string) (int64, error) {
+	units := map[string]int64{"K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}
+
+	number, unit := strings.TrimSuffix(strings.ToUpper(s), "B"), int64(1)
+	if len(number) > 0 {
+		if u, ok := units[number[len(number)-1:]]; ok {
+			number, unit = number[:len(number)-1], u
+		}
+	}
+
+	n, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, want e.g. 500M or 10G", s)
+	}
+	return n * unit, nil
+}
+
+// parseAge parses a duration like time.ParseDuration, and also accepts days like 30d.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid age %q, want e.g. 72h or 30d", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid age %q, want e.g. 72h or 30d", s)
+	}
+	return d, nil
+}
+
+// formatSize formats a number of bytes for humans.
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/build"
+	"github.com/julebarn/BSc-build-systems/cache"
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/makeimport"
+)
+
+// runBuild builds the targets and writes them to the output directory.
+func runBuild(args []string) int {
+	flags := flag.NewFlagSet("build", flag.ExitOnError)
+	o := addOptions(flags)
+	jobs := flags.Int("j", runtime.NumCPU(), "number of build nodes to run in parallel")
+	outDir := flags.String("o", "", "directory to write the built targets to (default: the project directory)")
+	remoteExecutor := flags.String("remote-executor", "", "host:port of a Remote Execution API endpoint for nodes using the remote executor")
+	remoteInstance := flags.String("remote-instance", "", "instance name to use on the remote executor")
+	remotePath := flags.String("remote-path", build.DefaultRemotePath, "PATH of the build commands run on the remote executor")
+	var keepGoing bool
+	flags.BoolVar(&keepGoing, "keep-going", false, "build every node that does not depend on a failed one, and list the failures at the end")
+	flags.BoolVar(&keepGoing, "k", false, "short for -keep-going")
+	limits := addCacheLimits(flags, "cache-")
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "no target specified")
+		flags.Usage()
+		return exitUsage
+	}
+
+	out, err := absPath(*outDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+	gcOptions, err := limits.options()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	p, graph, c, err := openProject(o, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	// The cache is trimmed to its limits after the build, also after a failed one.
+	if gcOptions.MaxSize > 0 || gcOptions.MaxAge > 0 {
+		defer func() {
+			if _, err := c.GC(gcOptions); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: failed to trim the cache: %v\n", err)
+			}
+		}()
+	}
+
+	if o.verbose {
+		fmt.Println("Build Graph:")
+		fmt.Println(graph.ToGraphviz())
+	}
+
+	buildgraph, err := graph.BuildGraphForTargets(p.targets...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error building graph for targets: %v\n", err)
+		return exitFailure
+	}
+
+	if o.verbose {
+		fmt.Println("Build Graph for targets:", strings.Join(p.targets, " "))
+		fmt.Println(buildgraph.ToGraphviz())
+
+		fmt.Println("Build Order:")
+		for _, node := range buildgraph.CalculateBuildOrder() {
+			fmt.Printf("Node: %s, Build Info: %+v\n", node.TargetFilePath, node.Info)
+		}
+	}
+
+	b, err := build.NewBuildEnvironment(context.Background())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating build environment: %v\n", err)
+		return exitFailure
+	}
+
+	if *remoteExecutor != "" {
+		re, err := build.NewRemoteExecutor(*remoteExecutor, *remoteInstance)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating remote executor: %v\n", err)
+			return exitFailure
+		}
+		defer re.Close()
+		re.SetPath(*remotePath)
+		b.SetExecutor(build.RemoteExecutorName, re)
+	}
+
+	b.SetKeepGoing(keepGoing)
+
+	err = b.BuildAll(buildgraph, c, *jobs)
+	var keepGoingErr *build.KeepGoingError
+	if err != nil && !errors.As(err, &keepGoingErr) {
+		fmt.Fprintf(os.Stderr, "Error building targets: %v\n", err)
+		return exitFailure
+	}
+
+	// In keep-going mode the targets that were built are written even if others failed.
+	for _, target := range p.targets {
+		if keepGoingErr != nil && keepGoingErr.Blocked(target) {
+			continue
+		}
+		if err := writeOutput(c, target, out); err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing output: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	if keepGoingErr != nil {
+		fmt.Fprintf(os.Stderr, "Build summary: %v\n", keepGoingErr)
+		return exitFailure
+	}
+
+	fmt.Println("Build completed successfully!")
+	return exitOK
+}
+
+// writeOutput writes the cached output of target below outDir.
+func writeOutput(c *cache.Cache, target string, outDir string) error {
+	out, hit, err := c.Get(target)
+	if err != nil {
+		return fmt.Errorf("failed to get output of %s from cache: %w", target, err)
+	}
+	if !hit {
+		return fmt.Errorf("output of %s is missing from the cache", target)
+	}
+
+	dest := filepath.Join(outDir, filepath.FromSlash(out.TargetPath))
+	return c.WriteEntry(out, dest)
+}
+
+// runClean removes the outputs of the build targets from the output directory. The
+// cache is only removed with -all, as failed builds keep it.
+func runClean(args []string) int {
+	flags := flag.NewFlagSet("clean", flag.ExitOnError)
+	o := addOptions(flags)
+	outDir := flags.String("o", "", "directory the targets were written to (default: the project directory)")
+	all := flags.Bool("all", false, "remove the cache as well, so the next build starts from scratch")
+	flags.Parse(args)
+
+	out, err := absPath(*outDir)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	p, err := loadProject(o, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	targets := p.targets
+	if len(targets) == 0 {
+		for target := range p.builder.Nodes {
+			targets = append(targets, target)
+		}
+		sort.Strings(targets)
+	}
+
+	sources := make(map[string]bool)
+	for _, node := range p.builder.SourceFiles {
+		sources[filepath.Clean(node.TargetFilePath)] = true
+	}
+
+	status := exitOK
+	for _, target := range targets {
+		node, exists := p.builder.Nodes[target]
+		if !exists {
+			fmt.Fprintf(os.Stderr, "Error: target file %s not found in dependency graph\n", target)
+			status = exitFailure
+			continue
+		}
+		// Additional outputs are removed together with the node producing them.
+		if node.BuildInfo.IsSourceFile || node.BuildInfo.ProducedBy != "" {
+			continue
+		}
+
+		for _, output := range node.BuildInfo.DeclaredOutputs(node.TargetFilePath) {
+			if sources[filepath.Clean(output.Path)] {
+				continue
+			}
+
+			path := filepath.Join(out, filepath.FromSlash(output.Path))
+			if _, err := os.Lstat(path); os.IsNotExist(err) {
+				continue
+			}
+			if err := os.RemoveAll(path); err != nil {
+				fmt.Fprintf(os.Stderr, "Error removing %s: %v\n", path, err)
+				status = exitFailure
+				continue
+			}
+			fmt.Println("Removed", path)
+		}
+	}
+
+	if *all {
+		if err := clearCache(p.cacheDir); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			status = exitFailure
+		}
+	}
+	return status
+}
+
+// runGraph prints the dependency graph, or the part of it the targets depend on.
+func runGraph(args []string) int {
+	flags := flag.NewFlagSet("graph", flag.ExitOnError)
+	o := addOptions(flags)
+	output := flags.String("o", "", "file to write the graph to instead of stdout")
+	flags.Parse(args)
+
+	outFile, err := absPath(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	p, graph, _, err := openProject(o, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	dot := graph.ToGraphviz()
+	if len(p.targets) > 0 {
+		dot, err = graph.SubgraphToGraphviz(p.targets...)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return exitFailure
+		}
+	}
+
+	if err := writeFile(outFile, dot); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing graph: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// runQuery lists targets of the graph:
+//
+//	query targets [patterns...]   every target, or the targets matching a glob
+//	query deps targets...         what the targets depend on
+//	query rdeps targets...        what depends on the targets
+func runQuery(args []string) int {
+	flags := flag.NewFlagSet("query", flag.ExitOnError)
+	o := addOptions(flags)
+	output := flags.String("o", "", "file to write the result to instead of stdout")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: BSc-build-systems query [flags] targets [patterns...] | deps targets... | rdeps targets...")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return exitUsage
+	}
+	kind, targets := flags.Arg(0), flags.Args()[1:]
+	if kind != "targets" && kind != "deps" && kind != "rdeps" {
+		fmt.Fprintf(os.Stderr, "unknown query %q\n", kind)
+		flags.Usage()
+		return exitUsage
+	}
+	if kind != "targets" && len(targets) == 0 {
+		fmt.Fprintf(os.Stderr, "query %s needs at least one target\n", kind)
+		return exitUsage
+	}
+
+	outFile, err := absPath(*output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitUsage
+	}
+
+	// Patterns are matched against the paths of the graph, so they are not resolved.
+	var patterns []string
+	if kind == "targets" {
+		patterns, targets = targets, nil
+	}
+
+	p, graph, _, err := openProject(o, targets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	var result []string
+	switch kind {
+	case "targets":
+		for target := range graph.Nodes {
+			if len(patterns) == 0 || matchesAnyGlob(patterns, target) {
+				result = append(result, target)
+			}
+		}
+		sort.Strings(result)
+	case "deps":
+		result, err = graph.Dependencies(p.targets...)
+	case "rdeps":
+		result, err = graph.Dependents(p.targets...)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	var sb strings.Builder
+	for _, target := range result {
+		sb.WriteString(target + "\n")
+	}
+	if err := writeFile(outFile, sb.String()); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing query result: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
+
+// matchesAnyGlob reports whether target matches one of the glob patterns.
+func matchesAnyGlob(patterns []string, target string) bool {
+	for _, pattern := range patterns {
+		if dependencybuilder.MatchGlob(pattern, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// runExplain prints for the targets and everything they depend on whether they would
+// be rebuilt, and why.
+func runExplain(args []string) int {
+	flags := flag.NewFlagSet("explain", flag.ExitOnError)
+	o := addOptions(flags)
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "no target specified")
+		flags.Usage()
+		return exitUsage
+	}
+
+	p, graph, _, err := openProject(o, flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	deps, err := graph.Dependencies(p.targets...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return exitFailure
+	}
+
+	seen := make(map[string]bool)
+	for _, target := range append(deps, p.targets...) {
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+
+		node := graph.Nodes[target]
+		if node.NeedsUpdate {
+			fmt.Printf("%s needs an update: %s\n", target, node.Reason)
+		} else {
+			fmt.Printf("%s is up to date\n", target)
+		}
+	}
+	return exitOK
+}
+
+// runImport converts a makefile into build.json nodes and prints them.
+func runImport(args []string) int {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	makefilePath := flags.String("f", "", "makefile to import (default: GNUmakefile, makefile or Makefile)")
+	image := flags.String("image", "gcc:latest", "docker image to run the build commands in")
+	executor := flags.String("executor", "", "executor of the imported build nodes")
+	output := flags.String("o", "", "file to write the build file to instead of stdout")
+	flags.Parse(args)
+
+	if *makefilePath == "" {
+		for _, name := range []string{"GNUmakefile", "makefile", "Makefile"} {
+			if _, err := os.Stat(name); err == nil {
+				*makefilePath = name
+				break
+			}
+		}
+		if *makefilePath == "" {
+			fmt.Fprintln(os.Stderr, "Error importing makefile: no makefile found")
+			return exitFailure
+		}
+	}
+
+	nodes, err := makeimport.Import(*makefilePath, flags.Args(), makeimport.Options{
+		DockerImage: *image,
+		Executor:    *executor,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error importing makefile: %v\n", err)
+		return exitFailure
+	}
+
+	data, err := json.MarshalIndent(nodes, "", "    ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error encoding build file: %v\n", err)
+		return exitFailure
+	}
+
+	if err := writeFile(*output, string(data)+"\n"); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing build file: %v\n", err)
+		return exitFailure
+	}
+	return exitOK
+}
@@ -0,0 +1,62 @@
+package dependencybuilder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+// CycleError reports a dependency cycle together with the place in the build file
+// where each edge of the cycle is declared.
+type CycleError struct {
+	Cycle   []string
+	EdgePos []Position
+}
+
+func (e *CycleError) Error() string {
+	var sb strings.Builder
+	sb.WriteString("dependency cycle: ")
+	sb.WriteString(strings.Join(e.Cycle, " -> "))
+
+	for i, pos := range e.EdgePos {
+		sb.WriteString(fmt.Sprintf("\n\t%s: %s -> %s", pos, e.Cycle[i], e.Cycle[i+1]))
+	}
+	return sb.String()
+}
+
+func newCycleError(jsonGraph []DependencyGraphJSON, cycle []string) *CycleError {
+	nodes := make(map[string]DependencyGraphJSON)
+	producers := make(map[string]DependencyGraphJSON)
+
+	for _, node := range jsonGraph {
+		nodes[node.TargetFilePath] = node
+
+		info := buildinfo.Info{Outputs: node.Outputs}
+		for _, output := range info.DeclaredOutputs(node.TargetFilePath)[1:] {
+			producers[output.Path] = node
+		}
+	}
+
+	err := &CycleError{Cycle: cycle}
+	for i := 0; i+1 < len(cycle); i++ {
+		from, to := cycle[i], cycle[i+1]
+
+		// An additional output depends on its producer; the edge is declared by the output list.
+		if producer, isOutput := producers[from]; isOutput {
+			err.EdgePos = append(err.EdgePos, producer.Pos)
+			continue
+		}
+
+		node := nodes[from]
+		pos := node.Pos
+		for j, dep := range node.Dependencies {
+			if dep == to {
+				pos = node.dependencyPosition(j)
+				break
+			}
+		}
+		err.EdgePos = append(err.EdgePos, pos)
+	}
+	return err
+}
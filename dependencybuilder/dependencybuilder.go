@@ -1,26 +1,99 @@
 package dependencybuilder
 
 import (
-	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
+	"strings"
 
 	"github.com/julebarn/BSc-build-systems/buildinfo"
 	"github.com/julebarn/BSc-build-systems/dependencygraph"
 )
 
-func ReadJSONDependencyGraph(path string) *dependencygraph.DependencyGraphBuilder {
+// ReadJSONDependencyGraph reads the build.json file at path. Every problem in the file is
+// reported with its position; if there is any, no graph is returned.
+func ReadJSONDependencyGraph(path string) (*dependencygraph.DependencyGraphBuilder, error) {
+	var errs ErrorList
+	jsonGraph, err := readJSONNodes(path, &errs)
+	if err != nil {
+		return nil, err
+	}
+	return buildDependencyGraph(jsonGraph, &errs)
+}
 
-	var jsonGraph []DependencyGraphJSON
+// ReadJSONNodes reads the build.json file at path and returns its nodes with globs and
+// pattern rules expanded, without checking that their dependencies exist.
+func ReadJSONNodes(path string) ([]DependencyGraphJSON, error) {
+	var errs ErrorList
+	jsonGraph, err := readJSONNodes(path, &errs)
+	if err != nil {
+		return nil, err
+	}
+	return jsonGraph, errs.Err()
+}
 
+func readJSONNodes(path string, errs *ErrorList) ([]DependencyGraphJSON, error) {
 	data, err := os.ReadFile(path)
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("failed to read build file %s: %w", path, err)
+	}
+
+	buildFile, ok := parseBuildFile(path, data, errs)
+	if !ok {
+		return nil, errs.Err()
 	}
 
-	json.Unmarshal(data, &jsonGraph)
+	buildFile.Targets = expandSourceGlobs(buildFile.Targets, filepath.Dir(path), errs)
+	return expandBuildFile(buildFile, errs), nil
+}
+
+// BuildDependencyGraph validates the nodes of a build file and adds them to a new dependency graph.
+// Dependencies with wildcards are expanded like in build.json.
+func BuildDependencyGraph(jsonGraph []DependencyGraphJSON) (*dependencygraph.DependencyGraphBuilder, error) {
+	var errs ErrorList
+	jsonGraph = expandDependencyGlobs(slices.Clone(jsonGraph), &errs)
+	return buildDependencyGraph(jsonGraph, &errs)
+}
+
+// Validate reports the problems of nodes that were not read from build.json, e.g. the
+// nodes of a build program. Cycles are only found once the graph is built. Dependencies
+// named by labels like "//lib:add.o" or ":add.o" are resolved when a workspace is loaded,
+// so they are not checked here.
+func Validate(jsonGraph []DependencyGraphJSON) error {
+	var errs ErrorList
+	jsonGraph = expandDependencyGlobs(slices.Clone(jsonGraph), &errs)
+	for i, node := range jsonGraph {
+		jsonGraph[i].Dependencies, jsonGraph[i].DependencyPos = nil, nil
+		for j, dep := range node.Dependencies {
+			if strings.HasPrefix(dep, "//") || strings.HasPrefix(dep, ":") {
+				continue
+			}
+			jsonGraph[i].Dependencies = append(jsonGraph[i].Dependencies, dep)
+			jsonGraph[i].DependencyPos = append(jsonGraph[i].DependencyPos, node.dependencyPosition(j))
+		}
+	}
+	validate(jsonGraph, &errs)
+	return errs.Err()
+}
 
-	fmt.Println(jsonGraph)
+// buildDependencyGraph is BuildDependencyGraph for nodes whose parsing already reported errs.
+func buildDependencyGraph(jsonGraph []DependencyGraphJSON, errs *ErrorList) (*dependencygraph.DependencyGraphBuilder, error) {
+	validate(jsonGraph, errs)
+	if err := errs.Err(); err != nil {
+		return nil, err
+	}
+
+	depGraph := newDependencyGraph(jsonGraph)
+
+	if cycle := depGraph.FindCycle(); cycle != nil {
+		return nil, newCycleError(jsonGraph, cycle)
+	}
+
+	return depGraph, nil
+}
+
+func newDependencyGraph(jsonGraph []DependencyGraphJSON) *dependencygraph.DependencyGraphBuilder {
 
 	var depGraph = dependencygraph.NewDependencyGraph()
 
@@ -30,7 +103,6 @@ func ReadJSONDependencyGraph(path string) *dependencygraph.DependencyGraphBuilde
 	for _, node := range jsonGraph {
 
 		if node.IsSourceFile{
-			fmt.Println("Adding source file: ", node.TargetFilePath)
 		}
 
 		depNode := depGraph.AddNode(
@@ -40,20 +112,30 @@ func ReadJSONDependencyGraph(path string) *dependencygraph.DependencyGraphBuilde
 				DockerImage:    node.DockerImage,
 				BuildCommand:   node.BuildCommand,
 				OutputFilePath: node.OutputFilePath,
+				Executor:       node.Executor,
+				Outputs:        node.Outputs,
+				WorkingDir:     node.WorkingDir,
 			},
 		)
 
 		nodeMap[node.TargetFilePath] = depNode
 
+		// Every additional output becomes its own target that depends on the node producing it.
+		for _, output := range depNode.BuildInfo.DeclaredOutputs(node.TargetFilePath)[1:] {
+			nodeMap[output.Path] = depGraph.AddNode(
+				output.Path,
+				buildinfo.Info{ProducedBy: node.TargetFilePath},
+				depNode,
+			)
+		}
+
 		for _, dep := range node.Dependencies {
 			depList = append(depList, [2]string{node.TargetFilePath, dep})
 		}
 	}
 
 	for _, dep := range depList {
-		if depNode, exists := nodeMap[dep[1]]; exists {
-			nodeMap[dep[0]].Dependencies = append(nodeMap[dep[0]].Dependencies, depNode)
-		}
+		nodeMap[dep[0]].Dependencies = append(nodeMap[dep[0]].Dependencies, nodeMap[dep[1]])
 	}
 	
 	return depGraph
@@ -66,7 +148,31 @@ type DependencyGraphJSON struct {
 
 	IsSourceFile bool `json:"is_source_file,omitempty"`
 
-	DockerImage    string `json:"docker_image,omitempty"`
-	BuildCommand   string `json:"build_command,omitempty"`
-	OutputFilePath string `json:"output_file_path,omitempty"`
+	DockerImage    string   `json:"docker_image,omitempty"`
+	BuildCommand   string   `json:"build_command,omitempty"`
+	OutputFilePath string   `json:"output_file_path,omitempty"`
+	Executor       string   `json:"executor,omitempty"`
+	Outputs        []string `json:"outputs,omitempty"`
+
+	// WorkingDir is the directory the build command runs in, relative to the build file.
+	WorkingDir string `json:"working_dir,omitempty"`
+
+	// Glob declares a source node for every file matching one of the patterns, except
+	// the files matching Exclude. A node with a glob has no target_file_path of its own.
+	Glob    []string `json:"glob,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+
+	// Pos is the position of the node in its build file and DependencyPos the position
+	// of each entry of Dependencies. They are used to report errors.
+	Pos           Position   `json:"-"`
+	DependencyPos []Position `json:"-"`
+}
+
+// dependencyPosition returns the position of the i-th dependency of node,
+// falling back to the node itself when it is not known.
+func (node DependencyGraphJSON) dependencyPosition(i int) Position {
+	if i < len(node.DependencyPos) {
+		return node.DependencyPos[i]
+	}
+	return node.Pos
 }
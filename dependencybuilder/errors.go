@@ -0,0 +1,141 @@
+package dependencybuilder
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Position is a location in a build file. Line and Column start at 1; a zero Column
+// means the position only names a line.
+type Position struct {
+	File   string
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	if p.Line == 0 {
+		return p.File
+	}
+	if p.Column == 0 {
+		return fmt.Sprintf("%s:%d", p.File, p.Line)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Column)
+}
+
+// positionAt returns the position of the byte at offset in data.
+func positionAt(file string, data []byte, offset int64) Position {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+
+	line, column := 1, 1
+	for _, b := range data[:offset] {
+		if b == '\n' {
+			line++
+			column = 1
+		} else {
+			column++
+		}
+	}
+	return Position{File: file, Line: line, Column: column}
+}
+
+// LoadError is a problem found in a build file.
+type LoadError struct {
+	Pos Position
+	Msg string
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// ErrorList collects every problem found in a build file, so they can be fixed at once.
+type ErrorList []*LoadError
+
+func (list *ErrorList) Add(pos Position, format string, args ...any) {
+	*list = append(*list, &LoadError{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+func (list ErrorList) Error() string {
+	var sb strings.Builder
+	for i, err := range list {
+		if i > 0 {
+			sb.WriteString("\n")
+		}
+		sb.WriteString(err.Error())
+	}
+	return sb.String()
+}
+
+// Err returns the list sorted by position without duplicates, or nil if it is empty.
+func (list ErrorList) Err() error {
+	if len(list) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i].Pos, list[j].Pos
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+
+	// A problem in a pattern rule is found once for every target the rule generates.
+	unique := list[:0]
+	for _, err := range list {
+		if len(unique) > 0 && *err == *unique[len(unique)-1] {
+			continue
+		}
+		unique = append(unique, err)
+	}
+	return unique
+}
+
+// didYouMean returns a hint naming the candidate closest to name, or an empty string
+// if no candidate is close enough to be a likely typo.
+func didYouMean(name string, candidates []string) string {
+	best := ""
+	bestDistance := len(name)/3 + 1
+
+	for _, candidate := range candidates {
+		d := editDistance(strings.ToLower(name), strings.ToLower(candidate))
+		if d < bestDistance || (d == bestDistance && best != "" && candidate < best) {
+			best = candidate
+			bestDistance = d
+		}
+	}
+
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
@@ -0,0 +1,242 @@
+package dependencybuilder
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+// Glob returns the files below dir that match one of patterns and none of excludes.
+// Patterns are slash separated and relative to dir. *, ? and [...] match within a
+// path element and ** matches any number of directories. Hidden directories are
+// skipped, unless they are part of the leading elements of a pattern without wildcards:
+// "./.config/*.json" searches .config, "./**/*.json" does not. Patterns starting with
+// "./" return paths that start with "./" as well, like the targets in build.json.
+func Glob(dir string, patterns []string, excludes []string) ([]string, error) {
+	for _, pattern := range append(append([]string{}, patterns...), excludes...) {
+		if err := checkGlobPattern(pattern); err != nil {
+			return nil, err
+		}
+	}
+
+	seen := make(map[string]bool)
+	var matches []string
+
+	for _, pattern := range patterns {
+		prefix := ""
+		if strings.HasPrefix(pattern, "./") {
+			prefix = "./"
+		}
+		elements := globElements(pattern)
+
+		// The walk starts at the directory named by the elements without wildcards.
+		static := 0
+		for static < len(elements)-1 && !hasGlobMeta(elements[static]) {
+			static++
+		}
+		root := filepath.Join(dir, filepath.FromSlash(path.Join(elements[:static]...)))
+
+		err := filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) && filePath == root {
+					return nil
+				}
+				return err
+			}
+
+			rel, err := filepath.Rel(dir, filePath)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+
+			if d.IsDir() {
+				if filePath == root {
+					return nil
+				}
+				if strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				// Without ** a pattern only matches files at the depth of its last element.
+				if !slices.Contains(elements, "**") && len(strings.Split(rel, "/")) >= len(elements) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if !matchGlob(elements, strings.Split(rel, "/")) || matchesAny(excludes, rel) {
+				return nil
+			}
+			if !seen[prefix+rel] {
+				seen[prefix+rel] = true
+				matches = append(matches, prefix+rel)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand glob %s: %w", pattern, err)
+		}
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// IsGlob reports whether name contains wildcards and is matched as a glob pattern.
+func IsGlob(name string) bool {
+	return hasGlobMeta(name)
+}
+
+// MatchGlob reports whether the slash separated name matches pattern.
+func MatchGlob(pattern string, name string) bool {
+	return matchGlob(globElements(pattern), globElements(name))
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+func checkGlobPattern(pattern string) error {
+	for _, element := range globElements(pattern) {
+		if _, err := path.Match(element, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// globElements splits a pattern or path into its elements, without a leading "./".
+func globElements(pattern string) []string {
+	return strings.Split(path.Clean(strings.TrimPrefix(pattern, "./")), "/")
+}
+
+func matchGlob(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for skip := 0; skip <= len(name); skip++ {
+			if matchGlob(pattern[1:], name[skip:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchGlob(pattern[1:], name[1:])
+}
+
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if MatchGlob(pattern, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// expandSourceGlobs replaces every node with a glob by a source node for each matching
+// file below dir. Files that are also declared explicitly keep their own node. A glob
+// that matches no files declares no nodes; the files it is meant for may all have been
+// deleted, and the targets built from them then drop out of the graph as well.
+func expandSourceGlobs(jsonGraph []DependencyGraphJSON, dir string, errs *ErrorList) []DependencyGraphJSON {
+	declared := make(map[string]bool)
+	for _, node := range jsonGraph {
+		if len(node.Glob) == 0 {
+			declared[node.TargetFilePath] = true
+		}
+	}
+
+	var expanded []DependencyGraphJSON
+	for _, node := range jsonGraph {
+		if len(node.Glob) == 0 {
+			if len(node.Exclude) > 0 {
+				errs.Add(node.Pos, "exclude can only be used together with glob")
+			}
+			expanded = append(expanded, node)
+			continue
+		}
+
+		if node.TargetFilePath != "" || node.BuildCommand != "" || node.DockerImage != "" || len(node.Dependencies) > 0 {
+			errs.Add(node.Pos, "a glob declares source files and must not have a target_file_path, build_command, docker_image or dependencies")
+			continue
+		}
+
+		files, err := Glob(dir, node.Glob, node.Exclude)
+		if err != nil {
+			errs.Add(node.Pos, "%v", err)
+			continue
+		}
+
+		for _, file := range files {
+			if declared[file] {
+				continue
+			}
+			declared[file] = true
+			expanded = append(expanded, DependencyGraphJSON{
+				TargetFilePath: file,
+				IsSourceFile:   true,
+				Pos:            node.Pos,
+			})
+		}
+	}
+	return expanded
+}
+
+// expandDependencyGlobs replaces every dependency with wildcards by the targets it matches.
+func expandDependencyGlobs(jsonGraph []DependencyGraphJSON, errs *ErrorList) []DependencyGraphJSON {
+	var targets []string
+	for _, node := range jsonGraph {
+		info := buildinfo.Info{Outputs: node.Outputs}
+		for _, output := range info.DeclaredOutputs(node.TargetFilePath) {
+			targets = append(targets, output.Path)
+		}
+	}
+	sort.Strings(targets)
+
+	for i, node := range jsonGraph {
+		if !slices.ContainsFunc(node.Dependencies, IsGlob) {
+			continue
+		}
+
+		var deps []string
+		var positions []Position
+		for j, dep := range node.Dependencies {
+			if !IsGlob(dep) {
+				deps = append(deps, dep)
+				positions = append(positions, node.dependencyPosition(j))
+				continue
+			}
+
+			if err := checkGlobPattern(dep); err != nil {
+				errs.Add(node.dependencyPosition(j), "%v", err)
+				continue
+			}
+
+			// A glob that matches nothing is not an error, like a source glob: deleting the
+			// last file it matched must not break the build file.
+			for _, target := range targets {
+				if target != node.TargetFilePath && MatchGlob(dep, target) {
+					deps = append(deps, target)
+					positions = append(positions, node.dependencyPosition(j))
+				}
+			}
+		}
+
+		jsonGraph[i].Dependencies = deps
+		jsonGraph[i].DependencyPos = positions
+	}
+	return jsonGraph
+}
@@ -0,0 +1,69 @@
+package dependencybuilder
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const globBuildFile = `[
+{"glob": ["./src/*.c"]},
+{
+    "target_file_path": "./all.txt",
+    "dependencies": ["./src/*.c"],
+    "build_command": "cat src/*.c > all.txt",
+    "executor": "local"
+}
+]`
+
+// allDependencies reads the build file in dir and returns the dependencies of ./all.txt.
+func allDependencies(t *testing.T, dir string) []string {
+	t.Helper()
+	buildFile := filepath.Join(dir, "build.json")
+	nodes, err := ReadJSONNodes(buildFile)
+	if err != nil {
+		t.Fatalf("ReadJSONNodes: %v", err)
+	}
+	if _, err := ReadJSONDependencyGraph(buildFile); err != nil {
+		t.Fatalf("ReadJSONDependencyGraph: %v", err)
+	}
+
+	for _, node := range nodes {
+		if node.TargetFilePath == "./all.txt" {
+			return node.Dependencies
+		}
+	}
+	t.Fatal("./all.txt is missing from the nodes")
+	return nil
+}
+
+func TestGlobMatchingNothing(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "build.json"), []byte(globBuildFile), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"add.c", "sub.c"} {
+		if err := os.WriteFile(filepath.Join(dir, "src", name), []byte("int x;\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := []string{"./src/add.c", "./src/sub.c"}
+	if got := allDependencies(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("dependencies = %q, want %q", got, want)
+	}
+
+	// Deleting every matched file leaves a build file that still loads.
+	for _, name := range []string{"add.c", "sub.c"} {
+		if err := os.Remove(filepath.Join(dir, "src", name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := allDependencies(t, dir); len(got) != 0 {
+		t.Errorf("dependencies = %q, want none", got)
+	}
+}
@@ -0,0 +1,285 @@
+package dependencybuilder
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// jsonKeys lists the keys a node in build.json may have.
+var jsonKeys = jsonFieldNames(reflect.TypeOf(DependencyGraphJSON{}))
+
+// patternRuleKeys lists the keys a rule in build.json may have.
+var patternRuleKeys = jsonFieldNames(reflect.TypeOf(PatternRuleJSON{}))
+
+// buildFileKeys lists the keys of the object form of build.json.
+var buildFileKeys = jsonFieldNames(reflect.TypeOf(BuildFile{}))
+
+func jsonFieldNames(t reflect.Type) []string {
+	var names []string
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseBuildFile decodes a build.json file. The file is either a list of nodes, or an
+// object with variables, pattern rules and a list of targets. Every node records
+// the positions of itself and its dependencies, so later errors can point at them.
+// Nodes with invalid keys or values are still returned as far as they could be decoded,
+// so the rest of the file can be checked as well; the problems are added to errs.
+func parseBuildFile(file string, data []byte, errs *ErrorList) (BuildFile, bool) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	tok, err := dec.Token()
+	if err != nil {
+		errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+		return BuildFile{}, false
+	}
+
+	switch tok {
+	case json.Delim('['):
+		nodes, ok := parseJSONList(file, data, dec, errs, decodeJSONNode)
+		return BuildFile{Targets: nodes}, ok
+	case json.Delim('{'):
+		return parseBuildFileObject(file, data, dec, errs)
+	}
+
+	errs.Add(positionAt(file, data, 0), "build file must contain a list of nodes or an object with targets")
+	return BuildFile{}, false
+}
+
+// parseBuildFileObject decodes the object form of a build file, after its opening brace.
+func parseBuildFileObject(file string, data []byte, dec *json.Decoder, errs *ErrorList) (BuildFile, bool) {
+	buildFile := BuildFile{IsTemplate: true}
+
+	for dec.More() {
+		offset := skipJSONSpace(data, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+			return BuildFile{}, false
+		}
+		key, _ := tok.(string)
+
+		switch key {
+		case "variables":
+			valueOffset := skipJSONSpace(data, dec.InputOffset())
+			var raw json.RawMessage
+			if err := dec.Decode(&raw); err != nil {
+				errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+				return BuildFile{}, false
+			}
+			if err := json.Unmarshal(raw, &buildFile.Variables); err != nil {
+				errs.Add(positionAt(file, data, valueOffset), "variables must be an object of strings")
+			}
+
+		case "rules", "targets":
+			listOffset := skipJSONSpace(data, dec.InputOffset())
+			tok, err := dec.Token()
+			if err != nil {
+				errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+				return BuildFile{}, false
+			}
+			if tok != json.Delim('[') {
+				errs.Add(positionAt(file, data, listOffset), "%s must be a list", key)
+				return BuildFile{}, false
+			}
+
+			var ok bool
+			if key == "rules" {
+				buildFile.Rules, ok = parseJSONList(file, data, dec, errs, decodePatternRule)
+			} else {
+				buildFile.Targets, ok = parseJSONList(file, data, dec, errs, decodeJSONNode)
+			}
+			if !ok {
+				return BuildFile{}, false
+			}
+
+		default:
+			errs.Add(positionAt(file, data, offset), "unknown key %q%s", key, didYouMean(key, buildFileKeys))
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+				return BuildFile{}, false
+			}
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+		return BuildFile{}, false
+	}
+
+	return buildFile, true
+}
+
+// parseJSONList decodes the elements of a JSON list with decode, after its opening bracket.
+func parseJSONList[T any](file string, data []byte, dec *json.Decoder, errs *ErrorList, decode func(file string, data []byte, start int64, raw json.RawMessage, errs *ErrorList) T) ([]T, bool) {
+	var elements []T
+	for dec.More() {
+		start := skipJSONSpace(data, dec.InputOffset())
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+			return nil, false
+		}
+
+		elements = append(elements, decode(file, data, start, raw, errs))
+	}
+
+	if _, err := dec.Token(); err != nil {
+		errs.Add(syntaxErrorPosition(file, data, dec, err), "invalid JSON: %v", err)
+		return nil, false
+	}
+
+	return elements, true
+}
+
+func decodeJSONNode(file string, data []byte, start int64, raw json.RawMessage, errs *ErrorList) DependencyGraphJSON {
+	pos := func(offset int64) Position {
+		return positionAt(file, data, start+offset)
+	}
+
+	if len(raw) == 0 || raw[0] != '{' {
+		errs.Add(pos(0), "node must be a JSON object")
+		return DependencyGraphJSON{Pos: pos(0)}
+	}
+
+	var node DependencyGraphJSON
+	depOffsets := decodeJSONObject(pos, raw, "node", jsonKeys, &node, errs)
+
+	node.Pos = pos(0)
+	for _, offset := range depOffsets {
+		node.DependencyPos = append(node.DependencyPos, pos(offset))
+	}
+	return node
+}
+
+func decodePatternRule(file string, data []byte, start int64, raw json.RawMessage, errs *ErrorList) PatternRuleJSON {
+	pos := func(offset int64) Position {
+		return positionAt(file, data, start+offset)
+	}
+
+	if len(raw) == 0 || raw[0] != '{' {
+		errs.Add(pos(0), "rule must be a JSON object")
+		return PatternRuleJSON{Pos: pos(0)}
+	}
+
+	var rule PatternRuleJSON
+	decodeJSONObject(pos, raw, "rule", patternRuleKeys, &rule, errs)
+	rule.Pos = pos(0)
+	return rule
+}
+
+// decodeJSONObject decodes raw into v, reporting unknown keys and values of the wrong type.
+// It returns the offsets of the strings in the dependencies list of the object.
+func decodeJSONObject(pos func(offset int64) Position, raw json.RawMessage, what string, knownKeys []string, v any, errs *ErrorList) []int64 {
+	keys, depOffsets := scanJSONNode(raw)
+
+	for key, offset := range keys {
+		if !isKnownKey(key, knownKeys) {
+			errs.Add(pos(offset), "unknown key %q%s", key, didYouMean(key, knownKeys))
+		}
+	}
+
+	if err := json.Unmarshal(raw, v); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			errs.Add(pos(typeErr.Offset), "%s must be of type %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+		} else {
+			errs.Add(pos(0), "invalid %s: %v", what, err)
+		}
+	}
+
+	return depOffsets
+}
+
+// isKnownKey reports whether key is one of knownKeys. Like encoding/json,
+// keys are matched case-insensitively.
+func isKnownKey(key string, knownKeys []string) bool {
+	for _, name := range knownKeys {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanJSONNode returns the offsets of the keys of a JSON object, and of the strings in
+// its dependencies list.
+func scanJSONNode(raw []byte) (map[string]int64, []int64) {
+	keys := make(map[string]int64)
+	var depOffsets []int64
+
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if _, err := dec.Token(); err != nil {
+		return keys, nil
+	}
+
+	for dec.More() {
+		offset := skipJSONSpace(raw, dec.InputOffset())
+		tok, err := dec.Token()
+		if err != nil {
+			break
+		}
+		key, _ := tok.(string)
+		keys[key] = offset
+
+		if !strings.EqualFold(key, "dependencies") {
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				break
+			}
+			continue
+		}
+
+		if tok, err := dec.Token(); err != nil || tok != json.Delim('[') {
+			break
+		}
+		for dec.More() {
+			depOffsets = append(depOffsets, skipJSONSpace(raw, dec.InputOffset()))
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				break
+			}
+		}
+		if _, err := dec.Token(); err != nil {
+			break
+		}
+	}
+
+	return keys, depOffsets
+}
+
+// skipJSONSpace returns the offset of the next token at or after offset,
+// skipping whitespace and the separators the decoder has not consumed yet.
+func skipJSONSpace(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) {
+		switch data[offset] {
+		case ' ', '\t', '\r', '\n', ',', ':':
+			offset++
+		default:
+			return offset
+		}
+	}
+	return offset
+}
+
+func syntaxErrorPosition(file string, data []byte, dec *json.Decoder, err error) Position {
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return positionAt(file, data, syntaxErr.Offset)
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return positionAt(file, data, int64(len(data)))
+	}
+	return positionAt(file, data, dec.InputOffset())
+}
@@ -0,0 +1,351 @@
+package dependencybuilder
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+// BuildFile is the object form of build.json. Besides the list of targets it can
+// define variables shared by the build commands and pattern rules that generate targets.
+type BuildFile struct {
+	Variables map[string]string     `json:"variables,omitempty"`
+	Rules     []PatternRuleJSON     `json:"rules,omitempty"`
+	Targets   []DependencyGraphJSON `json:"targets,omitempty"`
+
+	// IsTemplate is set for build files in the object form, whose build commands may
+	// refer to variables. The commands of the list form are used as they are.
+	IsTemplate bool `json:"-"`
+}
+
+// PatternRuleJSON describes how to build every target matching Pattern, e.g. "./%.o"
+// from the inputs "./%.c". The % stands for the same text in the pattern, the inputs,
+// the dependencies and the outputs.
+//
+// In the build command $in is replaced by the inputs and $out by the target, and
+// $NAME or ${NAME} by the variable NAME.
+type PatternRuleJSON struct {
+	Pattern      string   `json:"pattern,omitempty"`
+	Inputs       []string `json:"inputs,omitempty"`
+	Dependencies []string `json:"dependencies,omitempty"`
+
+	DockerImage  string   `json:"docker_image,omitempty"`
+	BuildCommand string   `json:"build_command,omitempty"`
+	Executor     string   `json:"executor,omitempty"`
+	Outputs      []string `json:"outputs,omitempty"`
+
+	Pos Position `json:"-"`
+}
+
+// maxRuleDepth bounds the chains of pattern rules that are followed to make an input,
+// and the nesting of variables.
+const maxRuleDepth = 16
+
+// ExpandBuildFile turns a build file into concrete nodes. Pattern rules generate a node for
+// every dependency that is not declared as a target but matches the rule, and complete
+// targets that are declared without a build command. Dependencies with wildcards are
+// replaced by the targets they match, including generated ones. Variables, $in and $out
+// are substituted in the build commands.
+func ExpandBuildFile(buildFile BuildFile) ([]DependencyGraphJSON, error) {
+	var errs ErrorList
+	nodes := expandBuildFile(buildFile, &errs)
+	return nodes, errs.Err()
+}
+
+func expandBuildFile(buildFile BuildFile, errs *ErrorList) []DependencyGraphJSON {
+	if !buildFile.IsTemplate {
+		return expandDependencyGlobs(buildFile.Targets, errs)
+	}
+
+	for _, rule := range buildFile.Rules {
+		if strings.Count(rule.Pattern, "%") != 1 {
+			errs.Add(rule.Pos, "rule pattern %q must contain a single %%", rule.Pattern)
+		}
+		if rule.BuildCommand == "" {
+			errs.Add(rule.Pos, "rule %q has no build_command", rule.Pattern)
+		}
+	}
+
+	x := &ruleExpander{
+		buildFile: buildFile,
+		errs:      errs,
+		declared:  make(map[string]bool),
+	}
+
+	for _, node := range buildFile.Targets {
+		x.declare(node)
+	}
+
+	// ruleInputs holds the inputs of the declared targets completed from a rule, by index.
+	ruleInputs := make(map[int][]string)
+	for i, node := range buildFile.Targets {
+		if !node.IsSourceFile && node.BuildCommand == "" {
+			if rule, stem, ok := x.ruleFor(node.TargetFilePath, 0); ok {
+				node, ruleInputs[i] = x.completeFromRule(node, rule, stem)
+			}
+		}
+		x.nodes = append(x.nodes, node)
+	}
+
+	// Generated nodes are appended while the list is walked, so their own
+	// dependencies are generated as well.
+	for i := 0; i < len(x.nodes); i++ {
+		for _, dep := range x.nodes[i].Dependencies {
+			if IsGlob(dep) {
+				x.generateGlob(dep)
+				continue
+			}
+			if x.declared[dep] {
+				continue
+			}
+			if rule, stem, ok := x.ruleFor(dep, 0); ok {
+				x.generate(dep, rule, stem)
+			}
+		}
+	}
+
+	// The commands of the declared targets are expanded once their dependency globs are,
+	// so $in lists the targets a glob matches.
+	x.nodes = expandDependencyGlobs(x.nodes, errs)
+	for i := range buildFile.Targets {
+		node := &x.nodes[i]
+		if node.IsSourceFile {
+			continue
+		}
+
+		inputs, fromRule := ruleInputs[i]
+		if !fromRule {
+			inputs = node.Dependencies
+		}
+		node.BuildCommand = x.expandCommand(node.BuildCommand, node.Pos, inputs, node.TargetFilePath)
+		node.DockerImage = x.expandCommand(node.DockerImage, node.Pos, inputs, node.TargetFilePath)
+	}
+
+	return x.nodes
+}
+
+type ruleExpander struct {
+	buildFile BuildFile
+	errs      *ErrorList
+
+	// declared holds every target and additional output that has a node.
+	declared map[string]bool
+	nodes    []DependencyGraphJSON
+}
+
+func (x *ruleExpander) declare(node DependencyGraphJSON) {
+	x.declared[node.TargetFilePath] = true
+	info := buildinfo.Info{Outputs: node.Outputs}
+	for _, output := range info.DeclaredOutputs(node.TargetFilePath)[1:] {
+		x.declared[output.Path] = true
+	}
+}
+
+// ruleFor returns the first rule whose pattern matches target and whose inputs are
+// declared or can be generated by rules themselves.
+func (x *ruleExpander) ruleFor(target string, depth int) (PatternRuleJSON, string, bool) {
+	if depth > maxRuleDepth {
+		return PatternRuleJSON{}, "", false
+	}
+
+	for _, rule := range x.buildFile.Rules {
+		stem, ok := matchTargetPattern(rule.Pattern, target)
+		if !ok {
+			continue
+		}
+
+		canMake := true
+		for _, input := range substituteStem(rule.Inputs, stem) {
+			if x.declared[input] {
+				continue
+			}
+			if _, _, ok := x.ruleFor(input, depth+1); !ok {
+				canMake = false
+				break
+			}
+		}
+		if canMake {
+			return rule, stem, true
+		}
+	}
+	return PatternRuleJSON{}, "", false
+}
+
+// completeFromRule fills in the parts of a declared target that its matching rule provides.
+// The inputs of the rule come before the dependencies listed by the target.
+func (x *ruleExpander) completeFromRule(node DependencyGraphJSON, rule PatternRuleJSON, stem string) (DependencyGraphJSON, []string) {
+	inputs := substituteStem(rule.Inputs, stem)
+
+	deps := append(append([]string{}, inputs...), substituteStem(rule.Dependencies, stem)...)
+	node.Dependencies = append(deps, node.Dependencies...)
+	// The positions of the target's own dependencies move behind the rule's.
+	if len(node.DependencyPos) > 0 {
+		positions := make([]Position, len(deps), len(node.Dependencies))
+		for i := range positions {
+			positions[i] = rule.Pos
+		}
+		node.DependencyPos = append(positions, node.DependencyPos...)
+	}
+
+	node.BuildCommand = rule.BuildCommand
+	if node.DockerImage == "" {
+		node.DockerImage = rule.DockerImage
+	}
+	if node.Executor == "" {
+		node.Executor = rule.Executor
+	}
+	if len(node.Outputs) == 0 {
+		node.Outputs = substituteStem(rule.Outputs, stem)
+	}
+	return node, inputs
+}
+
+// generate adds the node of target built by rule.
+func (x *ruleExpander) generate(target string, rule PatternRuleJSON, stem string) {
+	inputs := substituteStem(rule.Inputs, stem)
+
+	node := DependencyGraphJSON{
+		TargetFilePath: target,
+		Dependencies:   append(append([]string{}, inputs...), substituteStem(rule.Dependencies, stem)...),
+		DockerImage:    x.expandCommand(rule.DockerImage, rule.Pos, inputs, target),
+		BuildCommand:   x.expandCommand(rule.BuildCommand, rule.Pos, inputs, target),
+		Executor:       rule.Executor,
+		Outputs:        substituteStem(rule.Outputs, stem),
+		Pos:            rule.Pos,
+	}
+
+	x.declare(node)
+	x.nodes = append(x.nodes, node)
+}
+
+// generateGlob adds the nodes of the targets that rules make from declared targets and
+// that match the dependency glob, so the glob matches them once it is expanded. E.g. with
+// a rule "%.o" from "%.c", "*.o" stands for the object of every declared C file.
+func (x *ruleExpander) generateGlob(glob string) {
+	seen := make(map[string]bool)
+	var candidates []string
+	for _, rule := range x.buildFile.Rules {
+		if len(rule.Inputs) == 0 {
+			continue
+		}
+		for target := range x.declared {
+			stem, ok := matchTargetPattern(rule.Inputs[0], target)
+			if !ok {
+				continue
+			}
+			candidate := strings.ReplaceAll(rule.Pattern, "%", stem)
+			if !x.declared[candidate] && !seen[candidate] && MatchGlob(glob, candidate) {
+				seen[candidate] = true
+				candidates = append(candidates, candidate)
+			}
+		}
+	}
+	sort.Strings(candidates)
+
+	for _, candidate := range candidates {
+		if x.declared[candidate] {
+			continue
+		}
+		if rule, stem, ok := x.ruleFor(candidate, 0); ok {
+			x.generate(candidate, rule, stem)
+		}
+	}
+}
+
+// expandCommand substitutes $in, $out and the variables of the build file in command.
+// $$ stands for a literal dollar sign.
+func (x *ruleExpander) expandCommand(command string, pos Position, inputs []string, target string) string {
+	return x.expand(command, pos, inputs, target, 0)
+}
+
+func (x *ruleExpander) expand(text string, pos Position, inputs []string, target string, depth int) string {
+	if depth > maxRuleDepth {
+		x.errs.Add(pos, "variables nested too deeply in %q, does a variable refer to itself?", text)
+		return ""
+	}
+
+	var sb strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' {
+			sb.WriteByte(text[i])
+			continue
+		}
+
+		var name string
+		switch {
+		case i+1 < len(text) && text[i+1] == '$':
+			sb.WriteByte('$')
+			i++
+			continue
+		case i+1 < len(text) && text[i+1] == '{':
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				x.errs.Add(pos, "unterminated variable reference in %q", text)
+				return ""
+			}
+			name = text[i+2 : i+end]
+			i += end
+		default:
+			end := i + 1
+			for end < len(text) && isVariableChar(text[end]) {
+				end++
+			}
+			name = text[i+1 : end]
+			i = end - 1
+		}
+
+		switch name {
+		case "":
+			x.errs.Add(pos, "$ without a variable name in %q, use $$ for a literal dollar sign", text)
+		case "in":
+			relative := make([]string, 0, len(inputs))
+			for _, input := range inputs {
+				relative = append(relative, buildinfo.RelativePath(input))
+			}
+			sb.WriteString(strings.Join(relative, " "))
+		case "out":
+			sb.WriteString(buildinfo.RelativePath(target))
+		default:
+			value, defined := x.buildFile.Variables[name]
+			if !defined {
+				names := make([]string, 0, len(x.buildFile.Variables))
+				for variable := range x.buildFile.Variables {
+					names = append(names, variable)
+				}
+				x.errs.Add(pos, "undefined variable $%s%s", name, didYouMean(name, names))
+				continue
+			}
+			sb.WriteString(x.expand(value, pos, inputs, target, depth+1))
+		}
+	}
+	return sb.String()
+}
+
+func isVariableChar(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9')
+}
+
+// matchTargetPattern matches target against a pattern with a single % and returns
+// the text matched by the %.
+func matchTargetPattern(pattern string, target string) (string, bool) {
+	prefix, suffix, found := strings.Cut(pattern, "%")
+	if !found {
+		return "", false
+	}
+	if len(target) < len(prefix)+len(suffix) || !strings.HasPrefix(target, prefix) || !strings.HasSuffix(target, suffix) {
+		return "", false
+	}
+	return target[len(prefix) : len(target)-len(suffix)], true
+}
+
+func substituteStem(patterns []string, stem string) []string {
+	if len(patterns) == 0 {
+		return nil
+	}
+	substituted := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		substituted = append(substituted, strings.ReplaceAll(pattern, "%", stem))
+	}
+	return substituted
+}
@@ -0,0 +1,70 @@
+package dependencybuilder
+
+import (
+	"sort"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+)
+
+// validate checks the nodes of a build file for problems that would otherwise
+// only show up as a wrong or failing build.
+func validate(jsonGraph []DependencyGraphJSON, errs *ErrorList) {
+
+	// targets maps every target to the position it is declared at,
+	// including the additional outputs of a node.
+	targets := make(map[string]Position)
+	declare := func(target string, pos Position) {
+		if first, exists := targets[target]; exists {
+			errs.Add(pos, "duplicate target %q, first declared at %s", target, first)
+			return
+		}
+		targets[target] = pos
+	}
+
+	for _, node := range jsonGraph {
+		if node.TargetFilePath == "" {
+			errs.Add(node.Pos, "node has no target_file_path")
+			continue
+		}
+		declare(node.TargetFilePath, node.Pos)
+
+		if node.IsSourceFile {
+			if node.BuildCommand != "" {
+				errs.Add(node.Pos, "source file %q must not have a build_command", node.TargetFilePath)
+			}
+			if node.DockerImage != "" {
+				errs.Add(node.Pos, "source file %q must not have a docker_image", node.TargetFilePath)
+			}
+			if len(node.Dependencies) > 0 {
+				errs.Add(node.Pos, "source file %q must not have dependencies", node.TargetFilePath)
+			}
+			continue
+		}
+
+		if node.BuildCommand == "" {
+			errs.Add(node.Pos, "target %q has no build_command", node.TargetFilePath)
+		}
+		if node.DockerImage == "" && (node.Executor == "" || node.Executor == "docker") {
+			errs.Add(node.Pos, "target %q has no docker_image", node.TargetFilePath)
+		}
+
+		info := buildinfo.Info{Outputs: node.Outputs}
+		for _, output := range info.DeclaredOutputs(node.TargetFilePath)[1:] {
+			declare(output.Path, node.Pos)
+		}
+	}
+
+	names := make([]string, 0, len(targets))
+	for target := range targets {
+		names = append(names, target)
+	}
+	sort.Strings(names)
+
+	for _, node := range jsonGraph {
+		for i, dep := range node.Dependencies {
+			if _, exists := targets[dep]; !exists {
+				errs.Add(node.dependencyPosition(i), "%q depends on unknown target %q%s", node.TargetFilePath, dep, didYouMean(dep, names))
+			}
+		}
+	}
+}
@@ -1,9 +1,7 @@
 package dependencygraph
 
 import (
-	"crypto/md5"
 	"fmt"
-	"os"
 
 	"github.com/julebarn/BSc-build-systems/buildinfo"
 	"github.com/julebarn/BSc-build-systems/cache"
@@ -38,16 +36,32 @@ func (tree *DependencyGraphBuilder) AddNode(targetFilePath string, buildInfo bui
 	return node
 }
 
-func (tree *DependencyGraphBuilder) MakeDependencyGraph(filecache *cache.Cache) DependencyGraph {
+func (tree *DependencyGraphBuilder) MakeDependencyGraph(filecache *cache.Cache) (DependencyGraph, error) {
+
+	if err := tree.addDiscoveredDependencies(filecache); err != nil {
+		return DependencyGraph{}, err
+	}
+
+	if cycle := tree.FindCycle(); cycle != nil {
+		return DependencyGraph{}, &CycleError{Cycle: cycle}
+	}
 
 	tree.calculateDependencies()
 
-	tree.calculateNeedsUpdate(filecache)
+	if err := tree.calculateNeedsUpdate(filecache); err != nil {
+		return DependencyGraph{}, err
+	}
+
+	if err := tree.calculateActionChanges(filecache); err != nil {
+		return DependencyGraph{}, err
+	}
+
+	tree.widenDiscoveredDependencies()
 
 	return DependencyGraph{
 		Nodes:       tree.Nodes,
 		SourceFiles: tree.SourceFiles,
-	}
+	}, nil
 
 }
 
@@ -60,8 +74,19 @@ func (tree *DependencyGraphBuilder) calculateNeedsUpdate(filecache *cache.Cache)
 		}
 
 		if !hit {
-			fmt.Println("Cache miss for:", node.TargetFilePath)
-			node.needsUpdate(filecache)
+			node.needsUpdate("the source file is not in the cache yet")
+			continue
+		}
+
+		if target.IsTree {
+			dirDigest, err := cache.DirectoryDigest(node.TargetFilePath)
+			if err != nil {
+				return fmt.Errorf("failed to get directory hash: %w", err)
+			}
+
+			if target.ContentDigest() != dirDigest {
+				node.needsUpdate("the source directory changed")
+			}
 			continue
 		}
 
@@ -71,22 +96,110 @@ func (tree *DependencyGraphBuilder) calculateNeedsUpdate(filecache *cache.Cache)
 		}
 
 		if target.HashFile != fileHash {
-			node.needsUpdate(filecache)
+			node.needsUpdate("the source file changed")
+		}
+	}
+
+	return nil
+}
+
+// calculateActionChanges marks every rule node as needing an update whose cached output
+// was produced by a different action than the one the node describes now, e.g. because
+// its build command or docker image was changed, or whose output is not cached at all.
+func (tree *DependencyGraphBuilder) calculateActionChanges(filecache *cache.Cache) error {
+	visited := make(map[*DependencyGraphNode]bool)
+
+	for _, node := range tree.Nodes {
+		if err := node.checkAction(filecache, visited); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (node *DependencyGraphNode) checkAction(filecache *cache.Cache, visited map[*DependencyGraphNode]bool) error {
+	if visited[node] {
+		return nil
+	}
+	visited[node] = true
+
+	// The dependencies are checked first, so a changed dependency marks this
+	// node before its own action key is computed from the dependency outputs.
+	for _, dep := range node.Dependencies {
+		if err := dep.checkAction(filecache, visited); err != nil {
+			return err
 		}
 	}
 
+	if node.BuildInfo.IsSourceFile || node.NeedsUpdate {
+		return nil
+	}
+
+	target, hit, err := filecache.Get(node.TargetFilePath)
+	if err != nil {
+		return fmt.Errorf("failed to get target from cache: %w", err)
+	}
+	if !hit {
+		node.needsUpdate("the output is not in the cache")
+		return nil
+	}
+
+	if node.BuildInfo.ProducedBy != "" {
+		return node.checkProducedOutput(target, filecache)
+	}
+
+	var inputs []cache.ActionInput
+	for _, dep := range node.Dependencies {
+		input, hit, err := filecache.Get(dep.TargetFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to get target from cache: %w", err)
+		}
+		if !hit {
+			node.needsUpdate(fmt.Sprintf("the input %s is not in the cache", dep.TargetFilePath))
+			return nil
+		}
+		inputs = append(inputs, cache.NewActionInput(input))
+	}
+
+	var actionKey cache.Digest
+	if target.HasDiscoveredInputs {
+		actionKey, err = cache.DiscoveredActionKey(node.BuildInfo, inputs, target.DiscoveredInputs)
+	} else {
+		actionKey, err = cache.ActionKey(node.BuildInfo, inputs)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compute action key for %s: %w", node.TargetFilePath, err)
+	}
+
+	if target.ActionKey != actionKey {
+		node.needsUpdate("the build command, docker image or inputs changed")
+	}
+	return nil
+}
+
+// checkProducedOutput marks an additional output as needing an update when its cached
+// file was not written by the current action of the node producing it.
+func (node *DependencyGraphNode) checkProducedOutput(target cache.FileCacheEntry, filecache *cache.Cache) error {
+	producer, hit, err := filecache.Get(node.BuildInfo.ProducedBy)
+	if err != nil {
+		return fmt.Errorf("failed to get target from cache: %w", err)
+	}
+
+	if !hit || producer.ActionKey != target.ActionKey {
+		node.needsUpdate(fmt.Sprintf("the output is not the one last written by %s", node.BuildInfo.ProducedBy))
+	}
 	return nil
 }
 
-func getTargetFileHash(path string) ([16]byte, error) {
+func getTargetFileHash(path string) (cache.Digest, error) {
 
-	file, err := os.ReadFile(path)
+	d, err := cache.FileDigest(path)
 	if err != nil {
 		fmt.Println("Error reading file:", path, err)
-		return [16]byte{}, fmt.Errorf("failed to read file %s: %w", path, err)
+		return cache.Digest{}, fmt.Errorf("failed to read file %s: %w", path, err)
 	}
 
-	return md5.Sum(file), nil
+	return d, nil
 }
 
 func (tree *DependencyGraphBuilder) calculateDependencies() {
@@ -108,19 +221,21 @@ type DependencyGraphNode struct {
 
 	Dependent   []*DependencyGraphNode 
 	NeedsUpdate bool                   
+
+	// Reason explains why NeedsUpdate is set, e.g. that a source file changed.
+	Reason string
 }
 
-func (node *DependencyGraphNode) needsUpdate(filecache *cache.Cache) {
-	fmt.Println("Checking if node needs update:", node.TargetFilePath)
+func (node *DependencyGraphNode) needsUpdate(reason string) {
 	// If the node already needs an update, no need to check further
 	if node.NeedsUpdate {
 		return
 	}
 
 	node.NeedsUpdate = true
+	node.Reason = reason
 
 	for _, dep := range node.Dependent {
-		fmt.Println("Checking dependent node:", dep.TargetFilePath)
-		dep.needsUpdate(filecache)
+		dep.needsUpdate(fmt.Sprintf("it depends on %s, which needs an update", node.TargetFilePath))
 	}
 }
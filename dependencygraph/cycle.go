@@ -0,0 +1,78 @@
+package dependencygraph
+
+import (
+	"sort"
+	"strings"
+)
+
+// CycleError is returned for a dependency graph that is not acyclic.
+type CycleError struct {
+	// Cycle lists the targets on the cycle; the first target is repeated at the end.
+	Cycle []string
+}
+
+func (e *CycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Cycle, " -> ")
+}
+
+// FindCycle returns the targets on a dependency cycle, starting and ending with the same
+// target, or nil if the graph is acyclic. The search is deterministic, so the same graph
+// always reports the same cycle.
+func (tree *DependencyGraphBuilder) FindCycle() []string {
+	const (
+		unvisited = iota
+		inProgress
+		done
+	)
+
+	state := make(map[*DependencyGraphNode]int)
+	var stack []*DependencyGraphNode
+
+	var visit func(node *DependencyGraphNode) []string
+	visit = func(node *DependencyGraphNode) []string {
+		state[node] = inProgress
+		stack = append(stack, node)
+
+		for _, dep := range node.Dependencies {
+			switch state[dep] {
+			case inProgress:
+				// dep is on the stack, the cycle is the part of the stack from dep onwards.
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == dep {
+						for _, n := range stack[i:] {
+							cycle = append(cycle, n.TargetFilePath)
+						}
+						break
+					}
+				}
+				return append(cycle, dep.TargetFilePath)
+			case unvisited:
+				if cycle := visit(dep); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		stack = stack[:len(stack)-1]
+		state[node] = done
+		return nil
+	}
+
+	targets := make([]string, 0, len(tree.Nodes))
+	for target := range tree.Nodes {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	for _, target := range targets {
+		node := tree.Nodes[target]
+		if state[node] != unvisited {
+			continue
+		}
+		if cycle := visit(node); cycle != nil {
+			return cycle
+		}
+	}
+	return nil
+}
@@ -12,19 +12,30 @@ type DependencyGraph struct {
 }
 
 func (tree *DependencyGraph) BuildGraphForTarget(targetFilePath string) (*buildgraph.BuildGraph, error) {
+	return tree.BuildGraphForTargets(targetFilePath)
+}
 
-	node, exists := tree.Nodes[targetFilePath]
-	if !exists {
-		return nil, fmt.Errorf("target file %s not found in dependency graph", targetFilePath)
-	}
+// BuildGraphForTargets returns a single build graph containing every target and the
+// dependencies that have to be built for them.
+func (tree *DependencyGraph) BuildGraphForTargets(targetFilePaths ...string) (*buildgraph.BuildGraph, error) {
 
 	buildgraph := buildgraph.NewBuildGraph()
 
+	for _, targetFilePath := range targetFilePaths {
+		node, exists := tree.Nodes[targetFilePath]
+		if !exists {
+			return nil, fmt.Errorf("target file %s not found in dependency graph", targetFilePath)
+		}
 
+		// A target may already be in the graph as a dependency of an earlier one.
+		if _, exists := buildgraph.Node(node.TargetFilePath); exists {
+			continue
+		}
 
-	buildDependent := buildgraph.MakeNode(node.TargetFilePath, node.BuildInfo)
-	if err := DependencyToBuildGraphNode(node, buildDependent, buildgraph); err != nil {
-		return nil, fmt.Errorf("failed to convert dependency graph node to build graph node: %w", err)
+		buildDependent := buildgraph.MakeNode(node.TargetFilePath, node.BuildInfo)
+		if err := DependencyToBuildGraphNode(node, buildDependent, buildgraph); err != nil {
+			return nil, fmt.Errorf("failed to convert dependency graph node to build graph node: %w", err)
+		}
 	}
 
 	return buildgraph, nil
@@ -46,7 +57,14 @@ func DependencyToBuildGraphNode(dep *DependencyGraphNode, buildDependent *buildg
 	}
 
 	for _, depNode := range dep.Dependencies {
-	
+
+		// A dependency shared by several targets (e.g. a header) must only exist once
+		// in the build graph, otherwise it would be built once per dependent.
+		if existing, exists := buildGraph.Node(depNode.TargetFilePath); exists {
+			buildDependent.AddDependency(existing)
+			continue
+		}
+
 		buildDepNode := buildGraph.MakeNode(depNode.TargetFilePath, depNode.BuildInfo)
 	
 		err := DependencyToBuildGraphNode(depNode, buildDepNode, buildGraph)
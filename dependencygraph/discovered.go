@@ -0,0 +1,106 @@
+package dependencygraph
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/cache"
+)
+
+// addDiscoveredDependencies adds the headers read by C and C++ compiles as dependencies,
+// so that editing a header rebuilds exactly the objects that include it.
+//
+// The headers of a compile are known from the depfile of its last build. A compile that
+// has not been built yet cannot know them, so it depends on every header source file.
+// The depfile is only right as long as neither the compile nor its inputs changed, see
+// widenDiscoveredDependencies.
+func (tree *DependencyGraphBuilder) addDiscoveredDependencies(filecache *cache.Cache) error {
+	byPath := make(map[string]*DependencyGraphNode, len(tree.Nodes))
+	for target, node := range tree.Nodes {
+		byPath[buildinfo.RelativePath(target)] = node
+	}
+	headers := tree.headerSources()
+
+	for _, node := range tree.Nodes {
+		if node.BuildInfo.IsSourceFile || !node.BuildInfo.DiscoversHeaders() {
+			continue
+		}
+
+		target, hit, err := filecache.Get(node.TargetFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to get target from cache: %w", err)
+		}
+
+		if !hit || !target.HasDiscoveredInputs {
+			node.addHeaders(headers)
+			continue
+		}
+
+		for _, input := range target.DiscoveredInputs {
+			dep, exists := byPath[input]
+			if !exists || dep == node || !buildinfo.IsHeaderFile(input) || node.dependsOn(dep) {
+				continue
+			}
+			node.Dependencies = append(node.Dependencies, dep)
+		}
+	}
+
+	return nil
+}
+
+// widenDiscoveredDependencies makes every C and C++ compile that needs an update depend
+// on every header source file again. The depfile of its last build only lists the headers
+// it read back then: once the source or one of its headers changed, it may include a
+// header that is not in the list, and the compile would fail without it. That failure
+// does not replace the depfile, so the compile would keep failing until the cache is
+// removed. Compiles that are up to date keep the headers of their depfile, so editing an
+// unrelated header does not rebuild them.
+func (tree *DependencyGraphBuilder) widenDiscoveredDependencies() {
+	headers := tree.headerSources()
+
+	for _, node := range tree.Nodes {
+		if node.BuildInfo.IsSourceFile || !node.BuildInfo.DiscoversHeaders() || !node.NeedsUpdate {
+			continue
+		}
+
+		for _, dep := range node.addHeaders(headers) {
+			dep.Dependent = append(dep.Dependent, node)
+		}
+	}
+}
+
+// headerSources returns the header source files, sorted by target.
+func (tree *DependencyGraphBuilder) headerSources() []*DependencyGraphNode {
+	var headers []*DependencyGraphNode
+	for target, node := range tree.Nodes {
+		if node.BuildInfo.IsSourceFile && buildinfo.IsHeaderFile(target) {
+			headers = append(headers, node)
+		}
+	}
+	sort.Slice(headers, func(i, j int) bool { return headers[i].TargetFilePath < headers[j].TargetFilePath })
+	return headers
+}
+
+// addHeaders adds the headers node does not depend on yet as dependencies, and returns
+// them.
+func (node *DependencyGraphNode) addHeaders(headers []*DependencyGraphNode) []*DependencyGraphNode {
+	var added []*DependencyGraphNode
+	for _, dep := range headers {
+		if dep == node || node.dependsOn(dep) {
+			continue
+		}
+		node.Dependencies = append(node.Dependencies, dep)
+		added = append(added, dep)
+	}
+	return added
+}
+
+func (node *DependencyGraphNode) dependsOn(dep *DependencyGraphNode) bool {
+	for _, d := range node.Dependencies {
+		if d == dep {
+			return true
+		}
+	}
+	return false
+}
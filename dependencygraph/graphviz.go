@@ -7,10 +7,29 @@ import (
 )
 
 func (tree *DependencyGraph) ToGraphviz() string {
+	return toGraphviz(tree.Nodes)
+}
+
+// SubgraphToGraphviz returns the given targets and everything they depend on in the
+// same format as ToGraphviz.
+func (tree *DependencyGraph) SubgraphToGraphviz(targetFilePaths ...string) (string, error) {
+	deps, err := tree.Dependencies(targetFilePaths...)
+	if err != nil {
+		return "", err
+	}
+
+	nodes := make(map[string]*DependencyGraphNode)
+	for _, path := range append(deps, targetFilePaths...) {
+		nodes[path] = tree.Nodes[path]
+	}
+	return toGraphviz(nodes), nil
+}
+
+func toGraphviz(nodes map[string]*DependencyGraphNode) string {
 	var sb strings.Builder
 	sb.WriteString("digraph G {\n")
 
-	for _, node := range tree.Nodes {
+	for _, node := range nodes {
 		color := "black"
 		if node.NeedsUpdate {
 			color = "red"
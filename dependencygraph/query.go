@@ -0,0 +1,51 @@
+package dependencygraph
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Dependencies returns the targets that the given targets depend on, directly or
+// indirectly, sorted by path. The given targets are only included if one of them
+// depends on another.
+func (tree *DependencyGraph) Dependencies(targetFilePaths ...string) ([]string, error) {
+	return tree.closure(targetFilePaths, func(node *DependencyGraphNode) []*DependencyGraphNode {
+		return node.Dependencies
+	})
+}
+
+// Dependents returns the targets that depend on the given targets, directly or
+// indirectly, sorted by path. These are the targets rebuilt when one of them changes.
+func (tree *DependencyGraph) Dependents(targetFilePaths ...string) ([]string, error) {
+	return tree.closure(targetFilePaths, func(node *DependencyGraphNode) []*DependencyGraphNode {
+		return node.Dependent
+	})
+}
+
+func (tree *DependencyGraph) closure(targetFilePaths []string, next func(*DependencyGraphNode) []*DependencyGraphNode) ([]string, error) {
+	seen := make(map[*DependencyGraphNode]bool)
+	var stack []*DependencyGraphNode
+
+	for _, targetFilePath := range targetFilePaths {
+		node, exists := tree.Nodes[targetFilePath]
+		if !exists {
+			return nil, fmt.Errorf("target file %s not found in dependency graph", targetFilePath)
+		}
+		stack = append(stack, next(node)...)
+	}
+
+	var paths []string
+	for len(stack) > 0 {
+		node := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if seen[node] {
+			continue
+		}
+		seen[node] = true
+		paths = append(paths, node.TargetFilePath)
+		stack = append(stack, next(node)...)
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
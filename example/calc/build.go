@@ -0,0 +1,19 @@
+//go:build ignore
+
+// build.go describes the same graph as build.json with the Go build DSL.
+// It is used by running the build in a directory without a build.json.
+package main
+
+import "github.com/julebarn/BSc-build-systems/builddsl"
+
+func main() {
+	p := builddsl.New()
+	gcc := builddsl.GCC{}
+
+	p.Source("./numbers.h")
+	sources := p.Source("./calc.c", "./mult.c", "./add.c", "./sub.c")
+
+	gcc.Binary(p, "./calc", sources)
+
+	p.Main()
+}
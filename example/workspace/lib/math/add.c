@@ -0,0 +1,7 @@
+
+
+#include "numbers.h"
+
+int add (int a, int b) {
+    return a + b;
+}
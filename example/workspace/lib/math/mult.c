@@ -0,0 +1,7 @@
+
+
+#include "numbers.h"
+
+int mult(int a, int b) {
+    return a * b;
+}
@@ -0,0 +1,5 @@
+
+
+int add (int a, int b);
+int sub(int a, int b);
+int mult(int a, int b);
\ No newline at end of file
@@ -0,0 +1,6 @@
+
+#include "numbers.h"
+
+int sub(int a, int b) {
+    return a - b;
+}
\ No newline at end of file
@@ -1,118 +1,257 @@
 package main
 
 import (
-	"context"
+	"flag"
 	"fmt"
 	"os"
-	"strings"
+	"path/filepath"
 
-	"github.com/julebarn/BSc-build-systems/build"
-	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/builddsl"
 	"github.com/julebarn/BSc-build-systems/cache"
 	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/dependencygraph"
+	"github.com/julebarn/BSc-build-systems/starlarkbuild"
+	"github.com/julebarn/BSc-build-systems/workspace"
 )
 
-func main() {
+// Exit codes of the process.
+const (
+	exitOK      = 0
+	exitFailure = 1 // the build or command failed
+	exitUsage   = 2 // the command line is invalid, as reported by the flag package
+)
 
-	target := readArgument()
+const usage = `Usage: BSc-build-systems <command> [flags] [targets]
 
-	cacheDir := "./cache"
-	c := cache.NewCache(cacheDir)
+Commands:
+  build    build the targets (the default when no command is given)
+  clean    remove the built targets from the output directory
+  graph    print the dependency graph in the Graphviz format
+  query    list targets, or the dependencies or dependents of targets
+  explain  explain why targets would be rebuilt
+  cache    manage the cache: clear, collect garbage, verify or serve it to other builds
+  import   convert a makefile into build.json
 
-	bgBuilder := dependencybuilder.ReadJSONDependencyGraph("./build.json")
+Run "BSc-build-systems <command> -h" for the flags of a command.
+`
 
-	DependencyGraph := bgBuilder.MakeDependencyGraph(c)
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
 
-	fmt.Println("Build Graph:")
-	fmt.Println(DependencyGraph.ToGraphviz())
+func run(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "build":
+			return runBuild(args[1:])
+		case "clean":
+			return runClean(args[1:])
+		case "graph":
+			return runGraph(args[1:])
+		case "query":
+			return runQuery(args[1:])
+		case "explain":
+			return runExplain(args[1:])
+		case "cache":
+			return runCache(args[1:])
+		case "import":
+			return runImport(args[1:])
+		case "help", "-h", "-help", "--help":
+			fmt.Print(usage)
+			return exitOK
+		}
+	}
 
-	buildgraph, err := DependencyGraph.BuildGraphForTarget(target)
+	// Without a command the arguments are the flags and targets of a build.
+	return runBuild(args)
+}
 
-	if err != nil {
-		fmt.Printf("Error building graph for target: %v\n", err)
-		clearCache(cacheDir)
+// options are the flags shared by the commands that read the build graph.
+type options struct {
+	buildFile   string
+	cacheDir    string
+	verbose     bool
+	remoteCache string
 
-		return
-	}
-	fmt.Println("Build Graph for target:", target)
-	fmt.Println(buildgraph.ToGraphviz())
+	compressCache       bool
+	compressRemoteCache bool
+}
 
-	BuildOrder := buildgraph.CalculateBuildOrder()
+func addOptions(flags *flag.FlagSet) *options {
+	o := &options{}
+	flags.StringVar(&o.buildFile, "f", "", "build file to read (default: the workspace, or build.json, BUILD.star or build.go in the current directory)")
+	flags.StringVar(&o.cacheDir, "cache", "", "cache directory (default: cache in the project directory)")
+	flags.BoolVar(&o.verbose, "v", false, "print the dependency graph, the build graph and the build order")
+	flags.StringVar(&o.remoteCache, "remote-cache", "", "URL of an HTTP cache server shared with other builds")
+	flags.BoolVar(&o.compressCache, "cache-compress", true, "compress new cache entries with zstd")
+	flags.BoolVar(&o.compressRemoteCache, "remote-cache-compress", false, "download blobs from the remote cache compressed with zstd")
+	return o
+}
 
-	fmt.Println("Build Order:")
-	for _, node := range BuildOrder {
-		fmt.Printf("Node: %s, Build Info: %+v\n", node.TargetFilePath, node.Info)
-	}
+// project is a loaded build graph. Loading it changes the working directory to the
+// project directory, the workspace root or the directory of the build file, because
+// the paths of the graph are relative to it.
+type project struct {
+	builder  *dependencygraph.DependencyGraphBuilder
+	cacheDir string
+
+	// targets are the targets given on the command line as paths of the graph.
+	targets []string
+}
 
-	b, err := build.NewBuildEnvironment(context.Background())
+// loadProject reads the build graph selected by o and resolves targets to its paths.
+func loadProject(o *options, targets []string) (*project, error) {
+	cacheDir, err := absPath(o.cacheDir)
 	if err != nil {
-		fmt.Printf("Error creating build environment: %v\n", err)
-		clearCache(cacheDir)
-		return
+		return nil, err
 	}
 
-	for _, node := range BuildOrder {
+	p := &project{targets: targets}
 
-		err := b.Build(node, c)
+	if o.buildFile != "" {
+		buildFile, err := filepath.Abs(o.buildFile)
 		if err != nil {
-			fmt.Printf("Error building node %s: %v\n", node.TargetFilePath, err)
-			clearCache(cacheDir)
-			return
+			return nil, err
+		}
+		if err := os.Chdir(filepath.Dir(buildFile)); err != nil {
+			return nil, fmt.Errorf("failed to change to the directory of %s: %w", o.buildFile, err)
+		}
+		p.builder, err = readBuildFile(filepath.Base(buildFile))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read build file:\n%w", err)
+		}
+	} else {
+		root, inWorkspace, err := workspace.FindRoot(".")
+		if err != nil {
+			return nil, err
 		}
-	}
 
+		if inWorkspace {
+			// Targets given on the command line are relative to the current package.
+			p.targets = make([]string, 0, len(targets))
+			for _, target := range targets {
+				resolved, err := resolveTarget(root, target)
+				if err != nil {
+					return nil, err
+				}
+				p.targets = append(p.targets, resolved)
+			}
 
-	fmt.Println("Build completed successfully!")
-	out, hit, err := c.Get(target)
-	if err != nil {
-		fmt.Printf("Error getting output from cache: %v\n", err)
-		clearCache(cacheDir)
-		return
+			if err := os.Chdir(root); err != nil {
+				return nil, fmt.Errorf("failed to change to workspace root %s: %w", root, err)
+			}
+
+			// The cache is not part of any package.
+			ignore := []string{"cache"}
+			if cacheDir != "" {
+				if rel, err := filepath.Rel(root, cacheDir); err == nil {
+					ignore = append(ignore, rel)
+				}
+			}
+			p.builder, err = workspace.Load(".", ignore...)
+		} else {
+			p.builder, err = readDefaultBuildFile()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read build file:\n%w", err)
+		}
 	}
 
-	if !hit {
-		fmt.Println("Cache miss for output file, writing to disk.")
+	if cacheDir == "" {
+		cacheDir = "./cache"
 	}
+	p.cacheDir = cacheDir
+	return p, nil
+}
 
-	err = os.WriteFile(out.TargetPath, out.File, 0644)
+// openProject loads the project like loadProject and computes which of its nodes
+// need to be rebuilt.
+func openProject(o *options, targets []string) (*project, dependencygraph.DependencyGraph, *cache.Cache, error) {
+	p, err := loadProject(o, targets)
 	if err != nil {
-		clearCache(cacheDir)
-		fmt.Printf("Error writing output file: %v\n", err)
-		return
+		return nil, dependencygraph.DependencyGraph{}, nil, err
 	}
 
+	c := openCache(o, p.cacheDir)
+	graph, err := p.builder.MakeDependencyGraph(c)
+	if err != nil {
+		return nil, dependencygraph.DependencyGraph{}, nil, fmt.Errorf("failed to calculate dependency graph: %w", err)
+	}
+	return p, graph, c, nil
 }
 
-func readArgument() string {
-	if len(os.Args) < 2 {
-		panic("no target specified")
+// openCache opens the cache at cacheDir with the cache flags of o.
+func openCache(o *options, cacheDir string) *cache.Cache {
+	c := cache.NewCache(cacheDir)
+	c.SetCompression(o.compressCache)
+
+	if o.remoteCache != "" {
+		remote := cache.NewRemoteCache(o.remoteCache)
+		remote.SetCompression(o.compressRemoteCache)
+		c.SetRemote(remote)
 	}
-	return os.Args[1]
+	return c
 }
 
+// readDefaultBuildFile reads ./build.json. Without a build.json the Starlark build file
+// ./BUILD.star or the build program ./build.go is used instead.
+func readDefaultBuildFile() (*dependencygraph.DependencyGraphBuilder, error) {
+	if _, err := os.Stat("./build.json"); os.IsNotExist(err) {
+		if _, err := os.Stat("./BUILD.star"); err == nil {
+			return readBuildFile("./BUILD.star")
+		}
+		if _, err := os.Stat("./build.go"); err == nil {
+			return readBuildFile("./build.go")
+		}
+	}
+	return readBuildFile("./build.json")
+}
+
+// readBuildFile reads the build file at path with the frontend matching its extension.
+func readBuildFile(path string) (*dependencygraph.DependencyGraphBuilder, error) {
+	switch filepath.Ext(path) {
+	case ".star":
+		return starlarkbuild.Load(path)
+	case ".go":
+		return builddsl.Load(path)
+	default:
+		return dependencybuilder.ReadJSONDependencyGraph(path)
+	}
+}
 
-func SourceFile() buildinfo.Info {
-	return buildinfo.Info{
-		IsSourceFile: true,
+// resolveTarget returns the path relative to the workspace root of a target given on
+// the command line, which is either a label or a path relative to the current directory.
+func resolveTarget(root string, target string) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	pkg, err := filepath.Rel(root, cwd)
+	if err != nil {
+		return "", err
 	}
+	if pkg == "." {
+		pkg = ""
+	}
+	return workspace.Resolve(filepath.ToSlash(pkg), target)
 }
 
-func gcc(cmd string) buildinfo.Info {
-	return buildinfo.Info{
-		IsSourceFile:   false,
-		DockerImage:    "gcc:latest",
-		BuildCommand:   "gcc " + cmd,
-		OutputFilePath: "",
+// writeFile writes data to path, or to stdout if path is empty.
+func writeFile(path string, data string) error {
+	if path == "" {
+		_, err := os.Stdout.WriteString(data)
+		return err
 	}
+	return os.WriteFile(path, []byte(data), 0644)
 }
 
-func gccLink(outputFile string, inputFiles ...string) buildinfo.Info {
-	return buildinfo.Info{
-		IsSourceFile:   false,
-		DockerImage:    "gcc:latest",
-		BuildCommand:   fmt.Sprintf("gcc -o %s %s", outputFile, strings.Join(inputFiles, " ")),
-		OutputFilePath: outputFile,
+// absPath returns path as an absolute path, so it stays valid after loading a project
+// changes the working directory. An empty path stays empty.
+func absPath(path string) (string, error) {
+	if path == "" {
+		return "", nil
 	}
+	return filepath.Abs(path)
 }
 
 func clearCache(cacheDir string) error {
@@ -121,4 +260,4 @@ func clearCache(cacheDir string) error {
 	}
 	fmt.Println("Cache cleared.")
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,283 @@
+// Package makeimport converts a makefile into the nodes of a build.json file.
+//
+// It understands a practical subset of GNU make: variables (=, :=, ?=, +=), explicit
+// rules, pattern rules like %.o: %.c, make's builtin rules for C and C++, automatic
+// variables and the common text functions. Conditionals, includes and multi-line or
+// shell recipes are reported as errors, since they cannot be expressed as a single
+// build command.
+package makeimport
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+)
+
+// Options control the nodes generated for the rules of the makefile.
+type Options struct {
+	// DockerImage is the image every build command is run in.
+	DockerImage string
+
+	// Executor is the executor of every build node; empty selects the default.
+	Executor string
+}
+
+// Import reads the makefile at makefilePath and returns the nodes needed to build goals.
+// Without goals the default goal of the makefile is imported. Only targets reachable
+// from the goals are imported; file names are relative to the directory of the makefile.
+func Import(makefilePath string, goals []string, options Options) ([]dependencybuilder.DependencyGraphJSON, error) {
+	data, err := os.ReadFile(makefilePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read makefile %s: %w", makefilePath, err)
+	}
+
+	m, err := parse(makefilePath, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(goals) == 0 {
+		if m.defaultGoal == "" {
+			return nil, fmt.Errorf("%s: no targets", makefilePath)
+		}
+		goals = []string{m.defaultGoal}
+	}
+
+	im := &importer{
+		m:        m,
+		dir:      filepath.Dir(makefilePath),
+		options:  options,
+		resolved: make(map[string][]string),
+		visiting: make(map[string]bool),
+	}
+
+	for _, goal := range goals {
+		if _, err := im.resolve(goal, ""); err != nil {
+			return nil, err
+		}
+	}
+
+	sort.Slice(im.sources, func(i, j int) bool { return im.sources[i].TargetFilePath < im.sources[j].TargetFilePath })
+	return append(im.sources, im.rules...), nil
+}
+
+type importer struct {
+	m       *makefile
+	dir     string
+	options Options
+
+	// resolved maps every visited target to the nodes it stands for: itself for files,
+	// the nodes of its prerequisites for phony targets like "all".
+	resolved map[string][]string
+	visiting map[string]bool
+
+	sources []dependencybuilder.DependencyGraphJSON
+	rules   []dependencybuilder.DependencyGraphJSON
+}
+
+// resolve imports target and everything it depends on, and returns the nodes target stands for.
+func (im *importer) resolve(target string, neededBy string) ([]string, error) {
+	if nodes, done := im.resolved[target]; done {
+		return nodes, nil
+	}
+	if im.visiting[target] {
+		return nil, fmt.Errorf("%s: circular dependency on %s", im.m.file, target)
+	}
+	im.visiting[target] = true
+	defer delete(im.visiting, target)
+
+	if path.IsAbs(target) {
+		return nil, fmt.Errorf("%s: target %s is an absolute path, only files below the makefile can be imported", im.m.file, target)
+	}
+
+	r := im.ruleFor(target)
+
+	if r == nil || len(r.recipe) == 0 {
+		// Without a recipe a target is either a file that already exists, or a name
+		// for its prerequisites like "all".
+		var prereqs []string
+		if r != nil {
+			prereqs = r.prereqs
+		}
+
+		if !im.m.phony[target] && im.exists(target) {
+			nodes := []string{nodePath(target)}
+			im.resolved[target] = nodes
+			im.sources = append(im.sources, dependencybuilder.DependencyGraphJSON{
+				TargetFilePath: nodePath(target),
+				IsSourceFile:   true,
+			})
+			return nodes, nil
+		}
+
+		if r == nil {
+			if neededBy != "" {
+				return nil, fmt.Errorf("%s: no rule to make target %s, needed by %s", im.m.file, target, neededBy)
+			}
+			return nil, fmt.Errorf("%s: no rule to make target %s", im.m.file, target)
+		}
+
+		var nodes []string
+		for _, prereq := range prereqs {
+			prereqNodes, err := im.resolve(prereq, target)
+			if err != nil {
+				return nil, err
+			}
+			nodes = append(nodes, prereqNodes...)
+		}
+		nodes = dedup(nodes)
+		im.resolved[target] = nodes
+		return nodes, nil
+	}
+
+	if im.m.phony[target] {
+		return nil, fmt.Errorf("%s:%d: phony target %s has a recipe and cannot be imported", im.m.file, r.line, target)
+	}
+
+	var dependencies []string
+	for _, prereq := range r.prereqs {
+		prereqNodes, err := im.resolve(prereq, target)
+		if err != nil {
+			return nil, err
+		}
+		dependencies = append(dependencies, prereqNodes...)
+	}
+
+	command, err := im.command(target, r)
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := []string{nodePath(target)}
+	im.resolved[target] = nodes
+	im.rules = append(im.rules, dependencybuilder.DependencyGraphJSON{
+		TargetFilePath: nodePath(target),
+		Dependencies:   dedup(dependencies),
+		DockerImage:    im.options.DockerImage,
+		BuildCommand:   command,
+		Executor:       im.options.Executor,
+	})
+	return nodes, nil
+}
+
+// ruleFor returns the rule that builds target. An explicit rule without a recipe is
+// combined with the recipe of a matching pattern rule, as make does for object files
+// that only list additional headers.
+func (im *importer) ruleFor(target string) *rule {
+	explicit := im.m.explicit[target]
+	if explicit != nil && len(explicit.recipe) > 0 {
+		return explicit
+	}
+
+	candidates := append(append([]*rule{}, im.m.patterns...), builtinPatterns...)
+	for _, pattern := range candidates {
+		if len(pattern.recipe) == 0 {
+			continue
+		}
+		stem, ok := matchPattern(pattern.target, target)
+		if !ok {
+			continue
+		}
+
+		prereqs := make([]string, 0, len(pattern.prereqs))
+		for _, prereq := range pattern.prereqs {
+			prereqs = append(prereqs, strings.ReplaceAll(prereq, "%", stem))
+		}
+		if !im.canMake(prereqs) {
+			continue
+		}
+
+		r := &rule{target: target, prereqs: prereqs, recipe: pattern.recipe, line: pattern.line, stem: stem}
+		if explicit != nil {
+			r.prereqs = append(r.prereqs, explicit.prereqs...)
+		}
+		return r
+	}
+
+	return explicit
+}
+
+// canMake reports whether every prerequisite of a pattern rule exists or is mentioned
+// in the makefile, which is the condition make uses to choose a pattern rule.
+func (im *importer) canMake(prereqs []string) bool {
+	for _, prereq := range prereqs {
+		if !im.m.mentioned[prereq] && im.m.explicit[prereq] == nil && !im.exists(prereq) {
+			return false
+		}
+	}
+	return true
+}
+
+// command expands the recipe of r into a build command.
+func (im *importer) command(target string, r *rule) (string, error) {
+	if len(r.recipe) > 1 {
+		return "", fmt.Errorf("%s:%d: the recipe of %s has %d lines, only single-command recipes can be imported", im.m.file, r.line, target, len(r.recipe))
+	}
+
+	firstPrereq := ""
+	if len(r.prereqs) > 0 {
+		firstPrereq = r.prereqs[0]
+	}
+	auto := map[string]string{
+		"@": target,
+		"<": firstPrereq,
+		"^": strings.Join(dedup(r.prereqs), " "),
+		"+": strings.Join(r.prereqs, " "),
+		"?": strings.Join(dedup(r.prereqs), " "),
+		"*": r.stem,
+	}
+
+	command, err := im.m.expand(r.recipe[0], auto)
+	if err != nil {
+		return "", fmt.Errorf("%s:%d: %w", im.m.file, r.line, err)
+	}
+
+	// @, - and + at the start of a recipe only change how make runs the command.
+	command = strings.TrimLeft(command, "@-+ \t")
+	command = strings.Join(strings.Fields(command), " ")
+
+	if strings.ContainsAny(command, "|&;<>`") {
+		return "", fmt.Errorf("%s:%d: the recipe of %s uses shell syntax, which build commands do not support: %s", im.m.file, r.line, target, command)
+	}
+	if command == "" {
+		return "", fmt.Errorf("%s:%d: the recipe of %s is empty", im.m.file, r.line, target)
+	}
+	return command, nil
+}
+
+func (im *importer) exists(name string) bool {
+	_, err := os.Stat(filepath.Join(im.dir, filepath.FromSlash(name)))
+	return err == nil
+}
+
+// wildcard implements $(wildcard ...) relative to the directory of the makefile.
+func (m *makefile) wildcard(patterns string) (string, error) {
+	dir := filepath.Dir(m.file)
+
+	var matches []string
+	for _, pattern := range strings.Fields(patterns) {
+		found, err := filepath.Glob(filepath.Join(dir, filepath.FromSlash(pattern)))
+		if err != nil {
+			return "", fmt.Errorf("invalid wildcard pattern %s: %w", pattern, err)
+		}
+		for _, match := range found {
+			rel, err := filepath.Rel(dir, match)
+			if err != nil {
+				return "", err
+			}
+			matches = append(matches, filepath.ToSlash(rel))
+		}
+	}
+	sort.Strings(matches)
+	return strings.Join(matches, " "), nil
+}
+
+// nodePath returns the target path of the node for a make target.
+func nodePath(target string) string {
+	return "./" + path.Clean(target)
+}
@@ -0,0 +1,725 @@
+package makeimport
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// makefile is the parsed content of a makefile: its variables and rules.
+type makefile struct {
+	file string
+
+	vars     map[string]variable
+	explicit map[string]*rule
+	patterns []*rule
+	phony    map[string]bool
+
+	// mentioned holds every target and prerequisite named in an explicit rule.
+	mentioned map[string]bool
+
+	// defaultGoal is the first target of the makefile that is not special or a pattern.
+	defaultGoal string
+}
+
+type variable struct {
+	value string
+
+	// recursive variables (defined with =) are expanded every time they are used,
+	// simple variables (defined with :=) once when they are defined.
+	recursive bool
+}
+
+// rule is an explicit rule for a single target or a pattern rule.
+type rule struct {
+	target  string
+	prereqs []string
+	recipe  []string
+
+	// line is the line of the rule that provides the recipe, or of the first
+	// rule for the target if there is no recipe.
+	line int
+
+	// stem is the part of the target matched by the % of a pattern rule, $* in the recipe.
+	stem string
+}
+
+// line is a logical line of a makefile, with continuation lines joined.
+type line struct {
+	text   string
+	number int
+}
+
+// builtinVars are the variables make defines itself that are used by the builtin rules.
+var builtinVars = map[string]string{
+	"CC":  "cc",
+	"CXX": "g++",
+	"RM":  "rm -f",
+}
+
+// builtinPatterns are the builtin rules of make for compiling and linking C and C++.
+// They are used for targets that have no recipe in the makefile.
+var builtinPatterns = []*rule{
+	{target: "%.o", prereqs: []string{"%.c"}, recipe: []string{"$(CC) $(CFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<"}},
+	{target: "%.o", prereqs: []string{"%.cc"}, recipe: []string{"$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<"}},
+	{target: "%.o", prereqs: []string{"%.cpp"}, recipe: []string{"$(CXX) $(CXXFLAGS) $(CPPFLAGS) $(TARGET_ARCH) -c -o $@ $<"}},
+	{target: "%", prereqs: []string{"%.o"}, recipe: []string{"$(CC) $(LDFLAGS) $(TARGET_ARCH) $^ $(LOADLIBES) $(LDLIBS) -o $@"}},
+}
+
+// unsupportedDirectives are make directives outside of the supported subset.
+var unsupportedDirectives = map[string]bool{
+	"include":  true,
+	"-include": true,
+	"sinclude": true,
+	"ifeq":     true,
+	"ifneq":    true,
+	"ifdef":    true,
+	"ifndef":   true,
+	"else":     true,
+	"endif":    true,
+	"define":   true,
+	"endef":    true,
+	"vpath":    true,
+}
+
+func parse(file string, data []byte) (*makefile, error) {
+	m := &makefile{
+		file:      file,
+		vars:      make(map[string]variable),
+		explicit:  make(map[string]*rule),
+		phony:     make(map[string]bool),
+		mentioned: make(map[string]bool),
+	}
+	for name, value := range builtinVars {
+		m.vars[name] = variable{value: value}
+	}
+
+	// current holds the rules the following recipe lines belong to, and
+	// currentLine the line of the rule they follow.
+	var current []*rule
+	var currentLine int
+
+	for _, l := range splitLines(string(data)) {
+		if strings.HasPrefix(l.text, "\t") {
+			if current == nil {
+				if strings.TrimSpace(l.text) == "" {
+					continue
+				}
+				return nil, m.errorf(l.number, "recipe commences before first target")
+			}
+			command := strings.TrimSpace(l.text)
+			if command == "" || strings.HasPrefix(command, "#") {
+				continue
+			}
+			m.addRecipe(current, currentLine, command)
+			continue
+		}
+
+		text := strings.TrimSpace(stripComment(l.text))
+		if text == "" {
+			continue
+		}
+
+		keyword, rest, _ := strings.Cut(text, " ")
+		if unsupportedDirectives[keyword] {
+			return nil, m.errorf(l.number, "the %s directive is not supported", keyword)
+		}
+		if keyword == "export" || keyword == "override" {
+			text = strings.TrimSpace(rest)
+			if !strings.ContainsAny(text, "=:") {
+				continue
+			}
+		}
+
+		if name, op, value, ok := splitAssignment(text); ok {
+			if err := m.assign(l.number, name, op, value); err != nil {
+				return nil, err
+			}
+			current = nil
+			continue
+		}
+
+		rules, err := m.parseRule(l.number, text)
+		if err != nil {
+			return nil, err
+		}
+		current = rules
+		currentLine = l.number
+	}
+
+	if goal, ok := m.vars[".DEFAULT_GOAL"]; ok {
+		m.defaultGoal = strings.TrimSpace(goal.value)
+	}
+
+	return m, nil
+}
+
+// splitLines splits a makefile into logical lines. A backslash at the end of a line
+// continues it on the next line.
+func splitLines(text string) []line {
+	physical := strings.Split(strings.ReplaceAll(text, "\r\n", "\n"), "\n")
+
+	var lines []line
+	for i := 0; i < len(physical); i++ {
+		l := line{text: physical[i], number: i + 1}
+		for strings.HasSuffix(l.text, "\\") && i+1 < len(physical) {
+			i++
+			l.text = strings.TrimSuffix(l.text, "\\") + " " + strings.TrimLeft(physical[i], " \t")
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func stripComment(text string) string {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '\\' {
+			i++
+			continue
+		}
+		if text[i] == '#' {
+			return text[:i]
+		}
+	}
+	return text
+}
+
+// splitAssignment splits a variable assignment into the variable name, the operator
+// (=, :=, ::=, ?= or +=) and the value. ok is false if the line is not an assignment.
+func splitAssignment(text string) (name string, op string, value string, ok bool) {
+	for i := 0; i < len(text); i++ {
+		switch text[i] {
+		case '=':
+			op = "="
+			nameEnd := i
+			for _, prefix := range []string{"::", ":", "?", "+"} {
+				if strings.HasSuffix(text[:i], prefix) {
+					op = prefix + "="
+					nameEnd = i - len(prefix)
+					break
+				}
+			}
+			name = strings.TrimSpace(text[:nameEnd])
+			if name == "" || strings.ContainsAny(name, " \t") {
+				return "", "", "", false
+			}
+			return name, op, strings.TrimSpace(text[i+1:]), true
+		case ':':
+			// A colon that is not part of an assignment operator starts a rule.
+			rest := text[i:]
+			if !strings.HasPrefix(rest, ":=") && !strings.HasPrefix(rest, "::=") {
+				return "", "", "", false
+			}
+		case '$':
+			// Skip over variable references, which may contain colons and equal signs.
+			i = skipReference(text, i)
+		}
+	}
+	return "", "", "", false
+}
+
+// skipReference returns the index of the last byte of the variable reference starting at i.
+func skipReference(text string, i int) int {
+	if i+1 >= len(text) {
+		return i
+	}
+	open := text[i+1]
+	if open != '(' && open != '{' {
+		return i + 1
+	}
+	if end := matchingParen(text, i+1); end >= 0 {
+		return end
+	}
+	return len(text) - 1
+}
+
+func (m *makefile) assign(lineNumber int, name string, op string, value string) error {
+	switch op {
+	case "=":
+		m.vars[name] = variable{value: value, recursive: true}
+	case ":=", "::=":
+		expanded, err := m.expand(value, nil)
+		if err != nil {
+			return m.errorf(lineNumber, "%v", err)
+		}
+		m.vars[name] = variable{value: expanded}
+	case "?=":
+		if _, defined := m.vars[name]; !defined {
+			m.vars[name] = variable{value: value, recursive: true}
+		}
+	case "+=":
+		old, defined := m.vars[name]
+		if !defined {
+			m.vars[name] = variable{value: value, recursive: true}
+			break
+		}
+		if !old.recursive {
+			expanded, err := m.expand(value, nil)
+			if err != nil {
+				return m.errorf(lineNumber, "%v", err)
+			}
+			value = expanded
+		}
+		old.value = strings.TrimSpace(old.value + " " + value)
+		m.vars[name] = old
+	}
+	return nil
+}
+
+// parseRule parses a rule line "targets: prerequisites [; recipe]" and returns the
+// rules its recipe lines belong to.
+func (m *makefile) parseRule(lineNumber int, text string) ([]*rule, error) {
+	colon := -1
+	for i := 0; i < len(text); i++ {
+		if text[i] == '$' {
+			i = skipReference(text, i)
+			continue
+		}
+		if text[i] == ':' {
+			colon = i
+			break
+		}
+	}
+	if colon < 0 {
+		return nil, m.errorf(lineNumber, "missing separator")
+	}
+
+	targetText := text[:colon]
+	prereqText := strings.TrimPrefix(text[colon+1:], ":")
+
+	var inlineRecipe string
+	if before, after, found := strings.Cut(prereqText, ";"); found {
+		prereqText = before
+		inlineRecipe = strings.TrimSpace(after)
+	}
+
+	if containsOutsideReferences(prereqText, '=') {
+		return nil, m.errorf(lineNumber, "target-specific variables are not supported")
+	}
+
+	// Order-only prerequisites only affect the order of the build, which the
+	// dependency graph already derives from the other prerequisites.
+	prereqText, _, _ = strings.Cut(prereqText, "|")
+
+	targetText, err := m.expand(targetText, nil)
+	if err != nil {
+		return nil, m.errorf(lineNumber, "%v", err)
+	}
+	prereqText, err = m.expand(prereqText, nil)
+	if err != nil {
+		return nil, m.errorf(lineNumber, "%v", err)
+	}
+
+	targets := strings.Fields(targetText)
+	prereqs := strings.Fields(prereqText)
+	if len(targets) == 0 {
+		return nil, m.errorf(lineNumber, "rule without a target")
+	}
+
+	var rules []*rule
+	for _, target := range targets {
+		if target == ".PHONY" {
+			for _, prereq := range prereqs {
+				m.phony[prereq] = true
+			}
+			continue
+		}
+		if strings.HasPrefix(target, ".") && !strings.ContainsAny(target, "/%") {
+			// Other special targets like .SUFFIXES change how make behaves and are ignored.
+			continue
+		}
+
+		if strings.Contains(target, "%") {
+			r := &rule{target: target, prereqs: prereqs, line: lineNumber}
+			m.patterns = append(m.patterns, r)
+			rules = append(rules, r)
+			continue
+		}
+
+		if m.defaultGoal == "" {
+			m.defaultGoal = target
+		}
+
+		m.mentioned[target] = true
+		for _, prereq := range prereqs {
+			m.mentioned[prereq] = true
+		}
+
+		r, exists := m.explicit[target]
+		if !exists {
+			r = &rule{target: target, line: lineNumber}
+			m.explicit[target] = r
+		}
+		r.prereqs = append(r.prereqs, prereqs...)
+		rules = append(rules, r)
+	}
+
+	if inlineRecipe != "" {
+		m.addRecipe(rules, lineNumber, inlineRecipe)
+	}
+
+	return rules, nil
+}
+
+// addRecipe adds a recipe line to the rules defined at ruleLine. A recipe given by a
+// later rule for the same target replaces the earlier one, as in make.
+func (m *makefile) addRecipe(rules []*rule, ruleLine int, command string) {
+	for _, r := range rules {
+		if len(r.recipe) == 0 || r.line != ruleLine {
+			r.recipe = nil
+			r.line = ruleLine
+		}
+		r.recipe = append(r.recipe, command)
+	}
+}
+
+// containsOutsideReferences reports whether text contains c outside of variable references.
+func containsOutsideReferences(text string, c byte) bool {
+	for i := 0; i < len(text); i++ {
+		if text[i] == '$' {
+			i = skipReference(text, i)
+			continue
+		}
+		if text[i] == c {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *makefile) errorf(lineNumber int, format string, args ...any) error {
+	return fmt.Errorf("%s:%d: %s", m.file, lineNumber, fmt.Sprintf(format, args...))
+}
+
+// expand replaces the variable references and function calls in text. auto holds the
+// automatic variables of a recipe; it is nil outside of recipes.
+func (m *makefile) expand(text string, auto map[string]string) (string, error) {
+	return m.expandDepth(text, auto, 0)
+}
+
+// maxExpansionDepth bounds the nesting of variable expansions, so a variable that
+// refers to itself is reported instead of recursing forever.
+const maxExpansionDepth = 64
+
+func (m *makefile) expandDepth(text string, auto map[string]string, depth int) (string, error) {
+	if depth > maxExpansionDepth {
+		return "", fmt.Errorf("recursive variable reference in %q", text)
+	}
+
+	var out strings.Builder
+	for i := 0; i < len(text); i++ {
+		if text[i] != '$' {
+			out.WriteByte(text[i])
+			continue
+		}
+		if i+1 >= len(text) {
+			break
+		}
+
+		var ref string
+		switch open := text[i+1]; open {
+		case '$':
+			out.WriteByte('$')
+			i++
+			continue
+		case '(', '{':
+			end := matchingParen(text, i+1)
+			if end < 0 {
+				return "", fmt.Errorf("unterminated variable reference in %q", text)
+			}
+			ref = text[i+2 : end]
+			i = end
+		default:
+			ref = string(open)
+			i++
+		}
+
+		value, err := m.reference(ref, auto, depth)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(value)
+	}
+	return out.String(), nil
+}
+
+// matchingParen returns the index of the parenthesis closing the one at open.
+func matchingParen(text string, open int) int {
+	closing := byte(')')
+	if text[open] == '{' {
+		closing = '}'
+	}
+
+	level := 0
+	for i := open; i < len(text); i++ {
+		switch text[i] {
+		case text[open]:
+			level++
+		case closing:
+			level--
+			if level == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// reference expands the content of a single $(...) reference.
+func (m *makefile) reference(ref string, auto map[string]string, depth int) (string, error) {
+	if name, args, isCall := strings.Cut(ref, " "); isCall {
+		if function, known := functions[name]; known {
+			return m.call(name, function, args, auto, depth)
+		}
+	}
+
+	name, err := m.expandDepth(ref, auto, depth+1)
+	if err != nil {
+		return "", err
+	}
+
+	// Substitution references like $(SRCS:.c=.o).
+	if varName, subst, found := strings.Cut(name, ":"); found {
+		if from, to, ok := strings.Cut(subst, "="); ok {
+			value, err := m.variable(varName, auto, depth)
+			if err != nil {
+				return "", err
+			}
+			if !strings.Contains(from, "%") {
+				from, to = "%"+from, "%"+to
+			}
+			return patsubst(from, to, value), nil
+		}
+	}
+
+	return m.variable(name, auto, depth)
+}
+
+func (m *makefile) variable(name string, auto map[string]string, depth int) (string, error) {
+	// $(@D) and $(@F) are the directory and file part of an automatic variable.
+	if len(name) == 2 && (name[1] == 'D' || name[1] == 'F') && auto != nil {
+		if value, isAuto := auto[name[:1]]; isAuto {
+			var parts []string
+			for _, word := range strings.Fields(value) {
+				if name[1] == 'D' {
+					parts = append(parts, dirOf(word))
+				} else {
+					parts = append(parts, word[strings.LastIndex(word, "/")+1:])
+				}
+			}
+			return strings.Join(parts, " "), nil
+		}
+	}
+
+	if value, isAuto := auto[name]; isAuto {
+		return value, nil
+	}
+	if strings.ContainsAny(name, "@<^+*?") && len(name) == 1 {
+		return "", fmt.Errorf("automatic variable $%s used outside of a recipe", name)
+	}
+
+	v, defined := m.vars[name]
+	if !defined {
+		return "", nil
+	}
+	if !v.recursive {
+		return v.value, nil
+	}
+	return m.expandDepth(v.value, auto, depth+1)
+}
+
+type function func(m *makefile, args []string) (string, error)
+
+// functions are the make functions that are supported in the makefile.
+var functions map[string]function
+
+func init() {
+	functions = map[string]function{
+		"subst": func(m *makefile, args []string) (string, error) {
+			return strings.ReplaceAll(args[2], args[0], args[1]), nil
+		},
+		"patsubst": func(m *makefile, args []string) (string, error) {
+			return patsubst(strings.TrimSpace(args[0]), strings.TrimSpace(args[1]), args[2]), nil
+		},
+		"strip": func(m *makefile, args []string) (string, error) {
+			return strings.Join(strings.Fields(args[0]), " "), nil
+		},
+		"filter": func(m *makefile, args []string) (string, error) {
+			return filterWords(args[0], args[1], true), nil
+		},
+		"filter-out": func(m *makefile, args []string) (string, error) {
+			return filterWords(args[0], args[1], false), nil
+		},
+		"sort": func(m *makefile, args []string) (string, error) {
+			words := strings.Fields(args[0])
+			sort.Strings(words)
+			return strings.Join(dedup(words), " "), nil
+		},
+		"dir": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[0], dirOf), nil
+		},
+		"notdir": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[0], func(word string) string {
+				return word[strings.LastIndex(word, "/")+1:]
+			}), nil
+		},
+		"basename": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[0], func(word string) string {
+				dot := strings.LastIndex(word, ".")
+				if dot < 0 || dot < strings.LastIndex(word, "/") {
+					return word
+				}
+				return word[:dot]
+			}), nil
+		},
+		"suffix": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[0], func(word string) string {
+				dot := strings.LastIndex(word, ".")
+				if dot < 0 || dot < strings.LastIndex(word, "/") {
+					return ""
+				}
+				return word[dot:]
+			}), nil
+		},
+		"addprefix": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[1], func(word string) string { return strings.TrimSpace(args[0]) + word }), nil
+		},
+		"addsuffix": func(m *makefile, args []string) (string, error) {
+			return mapWords(args[1], func(word string) string { return word + strings.TrimSpace(args[0]) }), nil
+		},
+		"firstword": func(m *makefile, args []string) (string, error) {
+			words := strings.Fields(args[0])
+			if len(words) == 0 {
+				return "", nil
+			}
+			return words[0], nil
+		},
+		"wildcard": func(m *makefile, args []string) (string, error) {
+			return m.wildcard(args[0])
+		},
+	}
+}
+
+// functionArgs is the number of arguments of each function.
+var functionArgs = map[string]int{
+	"subst":      3,
+	"patsubst":   3,
+	"filter":     2,
+	"filter-out": 2,
+	"addprefix":  2,
+	"addsuffix":  2,
+}
+
+func (m *makefile) call(name string, function function, argText string, auto map[string]string, depth int) (string, error) {
+	n := functionArgs[name]
+	if n == 0 {
+		n = 1
+	}
+
+	args := splitArgs(argText, n)
+	if len(args) != n {
+		return "", fmt.Errorf("function %s expects %d arguments, got %d", name, n, len(args))
+	}
+
+	for i, arg := range args {
+		expanded, err := m.expandDepth(arg, auto, depth+1)
+		if err != nil {
+			return "", err
+		}
+		args[i] = expanded
+	}
+
+	return function(m, args)
+}
+
+// splitArgs splits the arguments of a function call at the top level commas. The last
+// of n arguments takes the rest of the text, commas included.
+func splitArgs(text string, n int) []string {
+	var args []string
+	level := 0
+	start := 0
+	for i := 0; i < len(text) && len(args) < n-1; i++ {
+		switch text[i] {
+		case '(', '{':
+			level++
+		case ')', '}':
+			level--
+		case ',':
+			if level == 0 {
+				args = append(args, text[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(args, text[start:])
+}
+
+// matchPattern matches word against a pattern containing a single %
+// and returns the part of word matched by the %.
+func matchPattern(pattern string, word string) (stem string, ok bool) {
+	prefix, suffix, hasPercent := strings.Cut(pattern, "%")
+	if !hasPercent {
+		return "", pattern == word
+	}
+	if len(word) < len(prefix)+len(suffix) || !strings.HasPrefix(word, prefix) || !strings.HasSuffix(word, suffix) {
+		return "", false
+	}
+	return word[len(prefix) : len(word)-len(suffix)], true
+}
+
+func patsubst(pattern string, replacement string, text string) string {
+	return mapWords(text, func(word string) string {
+		stem, ok := matchPattern(pattern, word)
+		if !ok {
+			return word
+		}
+		return strings.Replace(replacement, "%", stem, 1)
+	})
+}
+
+func filterWords(patterns string, text string, keep bool) string {
+	var words []string
+	for _, word := range strings.Fields(text) {
+		matched := false
+		for _, pattern := range strings.Fields(patterns) {
+			if _, ok := matchPattern(pattern, word); ok {
+				matched = true
+				break
+			}
+		}
+		if matched == keep {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func mapWords(text string, f func(word string) string) string {
+	var words []string
+	for _, word := range strings.Fields(text) {
+		if mapped := f(word); mapped != "" {
+			words = append(words, mapped)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+func dirOf(word string) string {
+	slash := strings.LastIndex(word, "/")
+	if slash < 0 {
+		return "./"
+	}
+	return word[:slash+1]
+}
+
+func dedup(words []string) []string {
+	seen := make(map[string]bool)
+	var unique []string
+	for _, word := range words {
+		if !seen[word] {
+			seen[word] = true
+			unique = append(unique, word)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,276 @@
+// Package starlarkbuild reads build files written in Starlark, the Python dialect of
+// Bazel. A BUILD.star file declares nodes with the builtins
+//
+//	source(paths...)                       declares source files and returns their paths
+//	glob(include, exclude=[])              returns the files matching the patterns
+//	rule(target, build_command, dependencies=[], docker_image="", executor="",
+//	     outputs=[], output_file_path="") declares a target and returns its path
+//
+// and can share macros through load("defs.star", "macro"). A loaded file is named
+// relative to the file loading it, or to the root with a leading "//", and must not lie
+// outside of the root. Starlark is hermetic: a build file cannot read the environment
+// or the clock, so it always describes the same graph for the same files.
+package starlarkbuild
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/dependencygraph"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// fileOptions allows loops and conditions at the top level of a build file, but no
+// while loops or recursion, so evaluating a build file always terminates.
+var fileOptions = &syntax.FileOptions{
+	Set:             true,
+	TopLevelControl: true,
+	GlobalReassign:  true,
+}
+
+// Load evaluates the Starlark build file at path and returns the graph it declares.
+func Load(path string) (*dependencygraph.DependencyGraphBuilder, error) {
+	nodes, err := Eval(path)
+	if err != nil {
+		return nil, err
+	}
+	return dependencybuilder.BuildDependencyGraph(nodes)
+}
+
+// Eval evaluates the Starlark build file at path and returns the nodes it declares,
+// in the order they were declared. Its directory is the root of the files it can load.
+func Eval(path string) ([]dependencybuilder.DependencyGraphJSON, error) {
+	return EvalIn(path, filepath.Dir(path))
+}
+
+// EvalIn evaluates the Starlark build file at path like Eval, but it can load every file
+// below root, e.g. the root of its workspace.
+func EvalIn(path string, root string) ([]dependencybuilder.DependencyGraphJSON, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &evaluator{
+		dir:     filepath.Dir(path),
+		root:    root,
+		modules: make(map[string]*module),
+	}
+	e.builtins = starlark.StringDict{
+		"source": starlark.NewBuiltin("source", e.source),
+		"glob":   starlark.NewBuiltin("glob", e.glob),
+		"rule":   starlark.NewBuiltin("rule", e.rule),
+	}
+
+	if _, err := e.exec(path); err != nil {
+		return nil, err
+	}
+	return e.nodes, nil
+}
+
+type evaluator struct {
+	dir      string
+	builtins starlark.StringDict
+	nodes    []dependencybuilder.DependencyGraphJSON
+
+	// root is the absolute directory that loaded files must lie in.
+	root string
+
+	// modules caches the files loaded with load(). A module that is still
+	// being evaluated has no globals yet, which reveals load cycles.
+	modules map[string]*module
+}
+
+type module struct {
+	globals starlark.StringDict
+	err     error
+}
+
+// exec evaluates the Starlark file at path with the builtins predeclared.
+func (e *evaluator) exec(path string) (starlark.StringDict, error) {
+	src, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read build file %s: %w", path, err)
+	}
+
+	thread := &starlark.Thread{
+		Name: path,
+		Load: e.load,
+		Print: func(thread *starlark.Thread, msg string) {
+			fmt.Printf("%s: %s\n", thread.CallFrame(1).Pos, msg)
+		},
+	}
+
+	globals, err := starlark.ExecFileOptions(fileOptions, thread, path, src, e.builtins)
+	if err != nil {
+		var evalErr *starlark.EvalError
+		if errors.As(err, &evalErr) {
+			return nil, errors.New(evalErr.Backtrace())
+		}
+		return nil, err
+	}
+	return globals, nil
+}
+
+// load evaluates a module named relative to the directory of the file loading it, or
+// to the root if the name starts with "//". The thread of a file is named by its path.
+func (e *evaluator) load(thread *starlark.Thread, name string) (starlark.StringDict, error) {
+	dir := filepath.Dir(thread.Name)
+	if rest, found := strings.CutPrefix(name, "//"); found {
+		dir, name = e.root, rest
+	}
+
+	path, err := filepath.Abs(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, err
+	}
+	rel, err := filepath.Rel(e.root, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("%s is outside of %s", path, e.root)
+	}
+
+	if m, loaded := e.modules[path]; loaded {
+		if m.globals == nil && m.err == nil {
+			return nil, fmt.Errorf("cycle in load graph involving %s", name)
+		}
+		return m.globals, m.err
+	}
+
+	m := &module{}
+	e.modules[path] = m
+	m.globals, m.err = e.exec(path)
+	return m.globals, m.err
+}
+
+// position returns the position of the Starlark code calling a builtin.
+func position(thread *starlark.Thread) dependencybuilder.Position {
+	pos := thread.CallFrame(1).Pos
+	return dependencybuilder.Position{
+		File:   pos.Filename(),
+		Line:   int(pos.Line),
+		Column: int(pos.Col),
+	}
+}
+
+func (e *evaluator) source(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	if len(kwargs) > 0 {
+		return nil, fmt.Errorf("%s: unexpected keyword arguments", fn.Name())
+	}
+
+	var paths []string
+	for _, arg := range args {
+		strs, err := stringList(fn.Name(), arg)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, strs...)
+	}
+
+	values := make([]starlark.Value, 0, len(paths))
+	for _, path := range paths {
+		e.nodes = append(e.nodes, dependencybuilder.DependencyGraphJSON{
+			TargetFilePath: path,
+			IsSourceFile:   true,
+			Pos:            position(thread),
+		})
+		values = append(values, starlark.String(path))
+	}
+	return starlark.NewList(values), nil
+}
+
+func (e *evaluator) glob(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var include, exclude starlark.Value = starlark.NewList(nil), starlark.NewList(nil)
+	if err := starlark.UnpackArgs(fn.Name(), args, kwargs, "include", &include, "exclude?", &exclude); err != nil {
+		return nil, err
+	}
+
+	patterns, err := stringList(fn.Name(), include)
+	if err != nil {
+		return nil, err
+	}
+	excludes, err := stringList(fn.Name(), exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := dependencybuilder.Glob(e.dir, patterns, excludes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fn.Name(), err)
+	}
+
+	values := make([]starlark.Value, 0, len(files))
+	for _, file := range files {
+		values = append(values, starlark.String(file))
+	}
+	return starlark.NewList(values), nil
+}
+
+func (e *evaluator) rule(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+	var target, buildCommand, dockerImage, executor, outputFilePath string
+	var dependencies, outputs starlark.Value = starlark.NewList(nil), starlark.NewList(nil)
+
+	err := starlark.UnpackArgs(fn.Name(), args, kwargs,
+		"target", &target,
+		"build_command", &buildCommand,
+		"dependencies?", &dependencies,
+		"docker_image?", &dockerImage,
+		"executor?", &executor,
+		"outputs?", &outputs,
+		"output_file_path?", &outputFilePath,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	deps, err := stringList(fn.Name(), dependencies)
+	if err != nil {
+		return nil, err
+	}
+	outs, err := stringList(fn.Name(), outputs)
+	if err != nil {
+		return nil, err
+	}
+
+	e.nodes = append(e.nodes, dependencybuilder.DependencyGraphJSON{
+		TargetFilePath: target,
+		Dependencies:   deps,
+		DockerImage:    dockerImage,
+		BuildCommand:   buildCommand,
+		OutputFilePath: outputFilePath,
+		Executor:       executor,
+		Outputs:        outs,
+		Pos:            position(thread),
+	})
+	return starlark.String(target), nil
+}
+
+// stringList converts a string or a sequence of strings to a list of strings.
+func stringList(fnName string, v starlark.Value) ([]string, error) {
+	if s, ok := starlark.AsString(v); ok {
+		return []string{s}, nil
+	}
+
+	iterable, ok := v.(starlark.Iterable)
+	if !ok {
+		return nil, fmt.Errorf("%s: got %s, want string or list of strings", fnName, v.Type())
+	}
+
+	var strs []string
+	iter := iterable.Iterate()
+	defer iter.Done()
+
+	var item starlark.Value
+	for iter.Next(&item) {
+		s, ok := starlark.AsString(item)
+		if !ok {
+			return nil, fmt.Errorf("%s: got list containing %s, want string", fnName, item.Type())
+		}
+		strs = append(strs, s)
+	}
+	return strs, nil
+}
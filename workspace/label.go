@@ -0,0 +1,42 @@
+package workspace
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Resolve returns the path relative to the workspace root of the target name, as it is
+// written in the build file of the package pkg. name is either a label or a path
+// relative to the package, e.g. Resolve("lib/math", "./add.o") and
+// Resolve("app", "//lib/math:add.o") both return "./lib/math/add.o".
+func Resolve(pkg string, name string) (string, error) {
+	switch {
+	case strings.HasPrefix(name, "//"):
+		labelPkg, target, hasTarget := strings.Cut(strings.TrimPrefix(name, "//"), ":")
+		if labelPkg != "" && (path.Clean(labelPkg) != labelPkg || labelPkg == ".." || strings.HasPrefix(labelPkg, "../")) {
+			return "", fmt.Errorf("invalid label %q: the package must be a clean path relative to the workspace root", name)
+		}
+		if !hasTarget {
+			if labelPkg == "" {
+				return "", fmt.Errorf("invalid label %q: it names no target", name)
+			}
+			// //lib/math is short for //lib/math:math.
+			target = path.Base(labelPkg)
+		}
+		pkg, name = labelPkg, target
+
+	case strings.HasPrefix(name, ":"):
+		name = strings.TrimPrefix(name, ":")
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("empty target name in package %q", "//"+pkg)
+	}
+
+	rel := path.Clean(strings.TrimPrefix(name, "/"))
+	if rel == "." || rel == ".." || strings.HasPrefix(rel, "../") {
+		return "", fmt.Errorf("%q is not a file of package %q, name the targets of other packages by a label like //lib/math:add.o", name, "//"+pkg)
+	}
+	return "./" + path.Join(pkg, rel), nil
+}
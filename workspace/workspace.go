@@ -0,0 +1,224 @@
+// Package workspace loads a build graph that is split across the directories of a
+// workspace. The root of a workspace is marked by a WORKSPACE file, and every directory
+// below it with a build file is a package. The targets of other packages are named by
+// labels:
+//
+//	//lib/math:add.o   the target add.o of the package lib/math
+//	//lib/math         the target math of the package lib/math
+//	:add.o             the target add.o of the package of the build file
+//
+// Plain paths like "./add.o" are relative to the directory of the build file, and the
+// build commands of a package run in its directory.
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/julebarn/BSc-build-systems/builddsl"
+	"github.com/julebarn/BSc-build-systems/buildinfo"
+	"github.com/julebarn/BSc-build-systems/dependencybuilder"
+	"github.com/julebarn/BSc-build-systems/dependencygraph"
+	"github.com/julebarn/BSc-build-systems/starlarkbuild"
+)
+
+// MarkerFile marks the root directory of a workspace.
+const MarkerFile = "WORKSPACE"
+
+// BuildFiles are the names of the build file of a package, in order of precedence.
+var BuildFiles = []string{"build.json", "BUILD.star", "build.go"}
+
+// Package is a directory of the workspace with a build file.
+type Package struct {
+	// Dir is the slash separated path of the package relative to the workspace root,
+	// "" for the root itself.
+	Dir string
+
+	// BuildFile is the path of the build file of the package.
+	BuildFile string
+}
+
+// FindRoot returns the closest directory containing a WORKSPACE file, starting at dir
+// and walking up. found is false if dir is not inside a workspace.
+func FindRoot(dir string) (root string, found bool, err error) {
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", false, err
+	}
+
+	for {
+		_, err := os.Stat(filepath.Join(dir, MarkerFile))
+		if err == nil {
+			return dir, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return "", false, fmt.Errorf("failed to look for %s in %s: %w", MarkerFile, dir, err)
+		}
+
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", false, nil
+		}
+		dir = parent
+	}
+}
+
+// Packages returns the packages of the workspace at root, sorted by directory. Hidden
+// directories, nested workspaces and the directories in ignore, given relative to
+// root, are skipped.
+func Packages(root string, ignore ...string) ([]Package, error) {
+	ignored := make(map[string]bool)
+	for _, dir := range ignore {
+		ignored[buildinfo.RelativePath(filepath.ToSlash(dir))] = true
+	}
+
+	var packages []Package
+	err := filepath.WalkDir(root, func(dirPath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, dirPath)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if rel == "." {
+			rel = ""
+		} else {
+			if strings.HasPrefix(d.Name(), ".") || ignored[rel] {
+				return filepath.SkipDir
+			}
+			if _, err := os.Stat(filepath.Join(dirPath, MarkerFile)); err == nil {
+				return filepath.SkipDir
+			}
+		}
+
+		for _, name := range BuildFiles {
+			buildFile := filepath.Join(dirPath, name)
+			if _, err := os.Stat(buildFile); err == nil {
+				packages = append(packages, Package{Dir: rel, BuildFile: buildFile})
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to find the packages of workspace %s: %w", root, err)
+	}
+	return packages, nil
+}
+
+// Load reads the build files of every package of the workspace at root and returns
+// the graph they describe together.
+func Load(root string, ignore ...string) (*dependencygraph.DependencyGraphBuilder, error) {
+	nodes, err := Nodes(root, ignore...)
+	if err != nil {
+		return nil, err
+	}
+	return dependencybuilder.BuildDependencyGraph(nodes)
+}
+
+// Nodes reads the build files of every package of the workspace at root and returns
+// their nodes, with every target and label replaced by its path relative to root.
+func Nodes(root string, ignore ...string) ([]dependencybuilder.DependencyGraphJSON, error) {
+	packages, err := Packages(root, ignore...)
+	if err != nil {
+		return nil, err
+	}
+
+	var nodes []dependencybuilder.DependencyGraphJSON
+	var errs []error
+	for _, pkg := range packages {
+		pkgNodes, err := readPackage(root, pkg)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		pkgNodes, err = resolveNodes(pkg.Dir, pkgNodes)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		nodes = append(nodes, pkgNodes...)
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+// readPackage returns the nodes declared by the build file of pkg in the workspace at
+// root. Starlark build files can load every file of the workspace.
+func readPackage(root string, pkg Package) ([]dependencybuilder.DependencyGraphJSON, error) {
+	switch filepath.Base(pkg.BuildFile) {
+	case "BUILD.star":
+		return starlarkbuild.EvalIn(pkg.BuildFile, root)
+	case "build.go":
+		return builddsl.Run(pkg.BuildFile)
+	default:
+		return dependencybuilder.ReadJSONNodes(pkg.BuildFile)
+	}
+}
+
+// resolveNodes names the targets, outputs and dependencies of the nodes of pkg by their
+// paths relative to the workspace root, and runs their build commands in pkg.
+func resolveNodes(pkg string, nodes []dependencybuilder.DependencyGraphJSON) ([]dependencybuilder.DependencyGraphJSON, error) {
+	var errs dependencybuilder.ErrorList
+
+	resolve := func(pos dependencybuilder.Position, name string) string {
+		target, err := Resolve(pkg, name)
+		if err != nil {
+			errs.Add(pos, "%v", err)
+			return name
+		}
+		return target
+	}
+
+	resolved := make([]dependencybuilder.DependencyGraphJSON, 0, len(nodes))
+	for _, node := range nodes {
+		node.TargetFilePath = resolve(node.Pos, node.TargetFilePath)
+		if node.OutputFilePath != "" {
+			node.OutputFilePath = resolve(node.Pos, node.OutputFilePath)
+		}
+
+		var outputs []string
+		for _, output := range node.Outputs {
+			if strings.HasSuffix(output, "/") {
+				outputs = append(outputs, resolve(node.Pos, strings.TrimSuffix(output, "/"))+"/")
+			} else {
+				outputs = append(outputs, resolve(node.Pos, output))
+			}
+		}
+		node.Outputs = outputs
+
+		var deps []string
+		for i, dep := range node.Dependencies {
+			pos := node.Pos
+			if i < len(node.DependencyPos) {
+				pos = node.DependencyPos[i]
+			}
+			deps = append(deps, resolve(pos, dep))
+		}
+		node.Dependencies = deps
+
+		if !node.IsSourceFile && pkg != "" {
+			node.WorkingDir = path.Join(pkg, node.WorkingDir)
+		}
+
+		resolved = append(resolved, node)
+	}
+
+	return resolved, errs.Err()
+}